@@ -0,0 +1,164 @@
+package cuckoo
+
+import (
+	"bytes"
+	"math/rand"
+
+	metro "github.com/dgryski/go-metro"
+)
+
+// numSelectors is the number of fingerprint functions a slot of an
+// AdaptiveFilter can choose from
+const numSelectors = 4
+
+// AdaptiveFilter is a cuckoo filter that can remove a known false positive
+// with Adapt, following the adaptive cuckoo filter design. Every slot has a
+// selector choosing which of numSelectors hash functions derives its
+// fingerprint, and the filter keeps the key stored in each slot so the
+// fingerprint can be recomputed when the selector changes. Lookup only
+// reads the fingerprints; the keys play the role of the remote
+// representation of the set.
+type AdaptiveFilter struct {
+	buckets   []bucket
+	selectors [][bucketSize]byte
+	keys      [][bucketSize][]byte
+	count     uint
+	bucketPow uint
+}
+
+// NewAdaptiveFilter returns a new AdaptiveFilter with the given capacity
+func NewAdaptiveFilter(capacity uint) *AdaptiveFilter {
+	bucketPow := getBucketPow(capacity)
+	n := 1 << bucketPow
+	return &AdaptiveFilter{
+		buckets:   make([]bucket, n),
+		selectors: make([][bucketSize]byte, n),
+		keys:      make([][bucketSize][]byte, n),
+		bucketPow: bucketPow,
+	}
+}
+
+// adaptiveFingerprint returns the fingerprint of data for a selector.
+// Selector 0 gives the same fingerprint as a Filter, which also decides the
+// alternate bucket.
+func adaptiveFingerprint(data []byte, selector byte) fingerprint {
+	if selector == 0 {
+		_, fp := getIndexAndFingerprint(data, 0)
+		return fp
+	}
+	return fingerprint(getFingerprint(metro.Hash64(data, 1337+uint64(selector))))
+}
+
+func (af *AdaptiveFilter) indices(data []byte) (uint, uint) {
+	i1, fp := getIndexAndFingerprint(data, af.bucketPow)
+	return i1, getAltIndex(fp, i1, af.bucketPow)
+}
+
+// matches returns whether slot j of bucket i holds data's fingerprint for
+// the slot's selector
+func (af *AdaptiveFilter) matches(data []byte, i uint, j int) bool {
+	fp := af.buckets[i][j]
+	return fp != nullFp && fp == adaptiveFingerprint(data, af.selectors[i][j])
+}
+
+// Lookup returns true if data is in the filter
+func (af *AdaptiveFilter) Lookup(data []byte) bool {
+	i1, i2 := af.indices(data)
+	for _, i := range [2]uint{i1, i2} {
+		for j := range af.buckets[i] {
+			if af.matches(data, i, j) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Insert inserts data into the filter, returning false if it is full
+func (af *AdaptiveFilter) Insert(data []byte) bool {
+	key := append([]byte(nil), data...)
+	i1, i2 := af.indices(key)
+	if af.place(key, i1) || af.place(key, i2) {
+		af.count++
+		return true
+	}
+	i := randi(i1, i2)
+	for k := 0; k < maxCuckooCount; k++ {
+		j := rand.Intn(bucketSize)
+		key, af.keys[i][j] = af.keys[i][j], key
+		af.set(i, j, 0)
+		_, fp := getIndexAndFingerprint(key, af.bucketPow)
+		i = getAltIndex(fp, i, af.bucketPow)
+		if af.place(key, i) {
+			af.count++
+			return true
+		}
+	}
+	return false
+}
+
+// place stores key in a free slot of bucket i
+func (af *AdaptiveFilter) place(key []byte, i uint) bool {
+	for j, k := range af.keys[i] {
+		if k == nil {
+			af.keys[i][j] = key
+			af.set(i, j, 0)
+			return true
+		}
+	}
+	return false
+}
+
+// set changes the selector of slot j in bucket i and recomputes its
+// fingerprint from the stored key
+func (af *AdaptiveFilter) set(i uint, j int, selector byte) {
+	af.selectors[i][j] = selector
+	af.buckets[i][j] = adaptiveFingerprint(af.keys[i][j], selector)
+}
+
+// Adapt changes the fingerprints that make falsePositive match, so that
+// Lookup no longer returns true for it. Stored keys keep matching their own
+// fingerprints, so adapting never causes false negatives. Adapt returns
+// false if falsePositive is in the filter or still matches afterwards,
+// which happens when a key agrees with it under every selector.
+func (af *AdaptiveFilter) Adapt(falsePositive []byte) bool {
+	i1, i2 := af.indices(falsePositive)
+	for _, i := range [2]uint{i1, i2} {
+		for _, key := range af.keys[i] {
+			if key != nil && bytes.Equal(key, falsePositive) {
+				return false
+			}
+		}
+	}
+	for _, i := range [2]uint{i1, i2} {
+		for j := range af.buckets[i] {
+			for n := 1; n < numSelectors && af.matches(falsePositive, i, j); n++ {
+				af.set(i, j, (af.selectors[i][j]+1)%numSelectors)
+			}
+		}
+	}
+	return !af.Lookup(falsePositive)
+}
+
+// Delete removes data from the filter. Unlike Filter.Delete it compares the
+// stored keys, so it never removes another item's fingerprint.
+func (af *AdaptiveFilter) Delete(data []byte) bool {
+	i1, i2 := af.indices(data)
+	for _, i := range [2]uint{i1, i2} {
+		for j, key := range af.keys[i] {
+			if key != nil && bytes.Equal(key, data) {
+				af.keys[i][j] = nil
+				af.selectors[i][j] = 0
+				af.buckets[i][j] = nullFp
+				af.count--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CountEntries returns the number of items in the filter
+func (af *AdaptiveFilter) CountEntries() uint {
+	return af.count
+}
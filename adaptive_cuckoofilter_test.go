@@ -0,0 +1,41 @@
+package cuckoo
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveFilter(t *testing.T) {
+	filter := NewAdaptiveFilter(1 << 12)
+	var members [][]byte
+	for i := 0; i < 3000; i++ {
+		member := []byte("AdaptiveFilter_" + strconv.Itoa(i))
+		if !filter.Insert(member) {
+			t.Fatalf("failed to insert %s", member)
+		}
+		members = append(members, member)
+	}
+	assert.EqualValues(t, len(members), filter.CountEntries())
+
+	var falsePositives [][]byte
+	for i := 0; len(falsePositives) < 20; i++ {
+		candidate := []byte("absent_" + strconv.Itoa(i))
+		if filter.Lookup(candidate) {
+			falsePositives = append(falsePositives, candidate)
+		}
+	}
+	for _, fp := range falsePositives {
+		assert.True(t, filter.Adapt(fp))
+		assert.False(t, filter.Lookup(fp))
+	}
+	for _, member := range members {
+		assert.True(t, filter.Lookup(member))
+	}
+	assert.False(t, filter.Adapt(members[0]))
+
+	assert.True(t, filter.Delete(members[0]))
+	assert.False(t, filter.Delete(members[0]))
+	assert.EqualValues(t, len(members)-1, filter.CountEntries())
+}
@@ -2,6 +2,8 @@ package cuckoo
 
 type fingerprint byte
 
+// bucket holds no pointers, so the garbage collector never scans a bucket
+// array, however large the filter
 type bucket [bucketSize]fingerprint
 
 const (
@@ -20,6 +22,9 @@ func (b *bucket) insert(fp fingerprint) bool {
 }
 
 func (b *bucket) delete(fp fingerprint) bool {
+	if fp == nullFp {
+		return false
+	}
 	for i, tfp := range b {
 		if tfp == fp {
 			b[i] = nullFp
@@ -38,6 +43,26 @@ func (b *bucket) getFingerprintIndex(fp fingerprint) int {
 	return -1
 }
 
+func (b *bucket) countFingerprint(fp fingerprint) int {
+	var n int
+	for _, tfp := range b {
+		if tfp == fp {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *bucket) occupied() uint {
+	var n uint
+	for _, tfp := range b {
+		if tfp != nullFp {
+			n++
+		}
+	}
+	return n
+}
+
 func (b *bucket) reset() {
 	for i := range b {
 		b[i] = nullFp
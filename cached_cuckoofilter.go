@@ -0,0 +1,92 @@
+package cuckoo
+
+import "container/list"
+
+// CachedFilter wraps a Filter with a small LRU cache of recent Lookup
+// results, so repeated lookups of hot keys skip hashing and bucket scans.
+// A cache hit still hashes the key for the map, so it only pays off when
+// Lookup is expensive, e.g. with WithKeyTransform, and the cache is large
+// enough to hold most of the hot keys.
+// Any mutation through the wrapper clears the cache. The wrapped filter must
+// not be modified directly, and a CachedFilter is not safe for concurrent
+// use since lookups update the cache.
+type CachedFilter struct {
+	filter  *Filter
+	size    int
+	entries map[string]*list.Element
+	recent  *list.List
+}
+
+type cacheEntry struct {
+	key   string
+	found bool
+}
+
+// NewCachedFilter returns a CachedFilter caching up to size lookup results
+// of filter
+func NewCachedFilter(filter *Filter, size int) *CachedFilter {
+	return &CachedFilter{
+		filter:  filter,
+		size:    size,
+		entries: make(map[string]*list.Element, size),
+		recent:  list.New(),
+	}
+}
+
+func (cf *CachedFilter) Lookup(data []byte) bool {
+	if e, ok := cf.entries[string(data)]; ok {
+		cf.recent.MoveToFront(e)
+		return e.Value.(*cacheEntry).found
+	}
+	found := cf.filter.Lookup(data)
+	if cf.size <= 0 {
+		return found
+	}
+	key := string(data)
+	if cf.recent.Len() >= cf.size {
+		// reuse the least recently used entry
+		oldest := cf.recent.Back()
+		entry := oldest.Value.(*cacheEntry)
+		delete(cf.entries, entry.key)
+		entry.key, entry.found = key, found
+		cf.entries[key] = oldest
+		cf.recent.MoveToFront(oldest)
+		return found
+	}
+	cf.entries[key] = cf.recent.PushFront(&cacheEntry{key: key, found: found})
+	return found
+}
+
+func (cf *CachedFilter) Insert(data []byte) bool {
+	cf.invalidate()
+	return cf.filter.Insert(data)
+}
+
+func (cf *CachedFilter) InsertUnique(data []byte) bool {
+	cf.invalidate()
+	return cf.filter.InsertUnique(data)
+}
+
+func (cf *CachedFilter) Delete(data []byte) bool {
+	cf.invalidate()
+	return cf.filter.Delete(data)
+}
+
+func (cf *CachedFilter) CountEntries() uint {
+	return cf.filter.CountEntries()
+}
+
+func (cf *CachedFilter) Reset() {
+	cf.invalidate()
+	cf.filter.Reset()
+}
+
+// invalidate empties the cache. Any insert may evict fingerprints and any
+// delete may remove a colliding one, so every cached result may be stale.
+func (cf *CachedFilter) invalidate() {
+	if cf.recent.Len() == 0 {
+		return
+	}
+	cf.entries = make(map[string]*list.Element, cf.size)
+	cf.recent.Init()
+}
@@ -0,0 +1,79 @@
+package cuckoo
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestCachedFilter(t *testing.T) {
+	filter := NewCachedFilter(NewFilter(1000), 2)
+	hot := []byte("hot")
+	assert.False(t, filter.Lookup(hot))
+	assert.False(t, filter.Lookup(hot))
+
+	assert.True(t, filter.Insert(hot))
+	assert.True(t, filter.Lookup(hot))
+	assert.True(t, filter.Lookup(hot))
+
+	assert.True(t, filter.Delete(hot))
+	assert.False(t, filter.Lookup(hot))
+
+	for i := 0; i < 10; i++ {
+		filter.Lookup([]byte("CachedFilter_" + strconv.Itoa(i)))
+	}
+	assert.Len(t, filter.entries, 2)
+	assert.Equal(t, 2, filter.recent.Len())
+
+	assert.True(t, filter.Insert(hot))
+	assert.Empty(t, filter.entries)
+	assert.True(t, filter.Lookup(hot))
+	assert.EqualValues(t, 1, filter.CountEntries())
+	filter.Reset()
+	assert.False(t, filter.Lookup(hot))
+}
+
+// zipfKeys returns n keys drawn from 10000 distinct ones with a skewed,
+// Zipfian distribution
+func zipfKeys(n int) [][]byte {
+	distinct := make([][]byte, 10000)
+	for i := range distinct {
+		distinct[i] = []byte("CachedFilter_key_that_is_somewhat_long_" + strconv.Itoa(i))
+	}
+	zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.2, 1, uint64(len(distinct)-1))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = distinct[zipf.Uint64()]
+	}
+	return keys
+}
+
+func BenchmarkCachedFilter_LookupZipf(b *testing.B) {
+	filter := NewFilter(10000, WithKeyTransform(norm.NFC.Bytes))
+	keys := zipfKeys(1 << 16)
+	for _, key := range keys[:5000] {
+		filter.Insert(key)
+	}
+	cached := NewCachedFilter(filter, 4096)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cached.Lookup(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkFilter_LookupZipf(b *testing.B) {
+	filter := NewFilter(10000, WithKeyTransform(norm.NFC.Bytes))
+	keys := zipfKeys(1 << 16)
+	for _, key := range keys[:5000] {
+		filter.Insert(key)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		filter.Lookup(keys[i%len(keys)])
+	}
+}
@@ -1,49 +1,267 @@
 package cuckoo
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"math/bits"
+	"math"
 	"math/rand"
 )
 
-const maxCuckooCount = 500
+const (
+	maxCuckooCount = 500
+	// minBuckets keeps two candidate buckets available to every item.
+	minBuckets = 2
+)
 
 // Filter is a probabilistic counter
 type Filter struct {
-	Buckets   []bucket
+	// Buckets may be filled directly, e.g. in tests, as long as Count is
+	// set to the number of fingerprints written: LoadFactor and
+	// OccupiedSlots track occupied slots relative to Count.
+	Buckets []bucket
+	// Count is the number of stored fingerprints. It never drops below 0
+	// and never exceeds Capacity(), since every insert fills a slot and
+	// every delete empties one, as long as Buckets and Count are only
+	// changed through the counter's methods.
 	Count     uint
 	BucketPow uint
+	// Tag is an application defined version stored in the encoded filter
+	Tag uint32
+	// Deletions is the number of fingerprints deleted over the counter's
+	// lifetime, not cleared by Reset. It is encoded only with
+	// WithDeletionsInHeader.
+	Deletions uint
+
+	keyTransform func([]byte) []byte
+	victimPolicy VictimPolicy
+	victimNext   int
+	evictions    map[int]int
+	// maxChain is the longest eviction chain since the last Reset
+	maxChain int
+	deleted  bool
+	// lost is set when a failed insert drops a stored fingerprint
+	lost bool
+	// skew is the number of non-empty slots in Buckets minus Count. It is
+	// 0 unless a delete found Count at 0 or Count was set out of step with
+	// Buckets, e.g. decoded from a corrupt header.
+	skew int
+	salt     uint64
+	// rng replaces the global source for evictions when set
+	rng *rand.Rand
+	// maxKicks bounds the evictions of a single insert when non-zero, see
+	// WithMaxKicks; kickSlots is scratch space recording the slot of every
+	// eviction so they can be undone, reused across inserts
+	maxKicks  int
+	kickSlots []uint8
+	// collapseDuplicates makes Insert skip fingerprints already stored in
+	// a candidate bucket, see WithCollapseDuplicates
+	collapseDuplicates bool
+	// deletionsInHeader makes encodings carry Deletions
+	deletionsInHeader bool
+}
+
+// VictimPolicy selects which slot of a full bucket is evicted on insert
+type VictimPolicy int
+
+const (
+	// VictimRandom evicts a random slot from a random candidate bucket
+	VictimRandom VictimPolicy = iota
+	// VictimRoundRobin cycles through the slots, starting from the
+	// primary bucket
+	VictimRoundRobin
+	// VictimFirstSlot always evicts slot 0, starting from the primary
+	// bucket
+	VictimFirstSlot
+)
+
+// FilterOption configures a Filter at construction
+type FilterOption func(*Filter)
+
+// WithKeyTransform applies fn to every key before it is hashed, e.g.
+// norm.NFC.Bytes to treat differently normalized strings as equal.
+func WithKeyTransform(fn func([]byte) []byte) FilterOption {
+	return func(cf *Filter) {
+		cf.keyTransform = fn
+	}
+}
+
+// WithVictimPolicy sets how evictions pick their victim. The non-random
+// policies make eviction chains reproducible for identical inputs.
+func WithVictimPolicy(policy VictimPolicy) FilterOption {
+	return func(cf *Filter) {
+		cf.victimPolicy = policy
+	}
+}
+
+// WithEvictionHistogram makes the filter record how many evictions each
+// insert needed, see EvictionHistogram
+func WithEvictionHistogram() FilterOption {
+	return func(cf *Filter) {
+		cf.evictions = make(map[int]int)
+	}
+}
+
+// WithSalt mixes salt into the hash of every key, so filters with different
+// salts place the same key in unrelated buckets with unrelated
+// fingerprints. Unlike the other options the salt is encoded, in a version 4
+// header that also carries Deletions, so a decoded filter hashes with the
+// same salt. Decoders predating version 4 can not read these encodings.
+func WithSalt(salt uint64) FilterOption {
+	return func(cf *Filter) {
+		cf.salt = salt
+	}
+}
+
+// WithRandSource makes evictions draw from src instead of the global
+// source of math/rand, so identical inserts always produce the same layout.
+// The counter then must not be used concurrently, as a rand.Source is not
+// safe for concurrent use.
+func WithRandSource(src rand.Source) FilterOption {
+	return func(cf *Filter) {
+		cf.rng = rand.New(src)
+	}
+}
+
+// WithMaxKicks bounds the number of evictions a single insert may perform
+// to n, which must be below the default of 500. An insert exceeding the
+// budget fails softly: its evictions are undone, so the counter is left as
+// it was and the item can be retried later or stored elsewhere. Smaller
+// budgets bound insert latency at the cost of a lower reachable load.
+func WithMaxKicks(n int) FilterOption {
+	return func(cf *Filter) {
+		if n > 0 && n < maxCuckooCount {
+			cf.maxKicks = n
+		}
+	}
+}
+
+// WithCollapseDuplicates makes every insert, e.g. Insert, InsertSpill,
+// InsertBatchCollect and NewFilterParallel, report success without taking
+// a slot when data's fingerprint is already stored in one of its candidate
+// buckets, so inserting the same key repeatedly does not fill the filter. This is approximate: a different key with a colliding
+// fingerprint is not stored either, and a later Delete of one of the two
+// removes both.
+func WithCollapseDuplicates() FilterOption {
+	return func(cf *Filter) {
+		cf.collapseDuplicates = true
+	}
+}
+
+// WithDeletionsInHeader makes Encode and EncodeSparse write a version 3
+// header carrying Deletions, so the lifetime deletion count survives
+// decoding. Filters decoded from such a header keep writing it. Decoders
+// predating version 3 can not read these encodings.
+func WithDeletionsInHeader() FilterOption {
+	return func(cf *Filter) {
+		cf.deletionsInHeader = true
+	}
 }
 
 // NewFilter returns a new cuckoofilter with a given capacity.
 // A capacity of 1000000 is a normal default, which allocates
 // about ~1MB on 64-bit machines.
-func NewFilter(capacity uint) *Filter {
-	capacity = getNextPow2(uint64(capacity)) / bucketSize
-	if capacity == 0 {
-		capacity = 1
+// The capacity is rounded up to a power of two and never below
+// minBuckets buckets, so the smallest filter holds 2*bucketSize items.
+// It is capped at 2^maxBucketPow buckets.
+func NewFilter(capacity uint, opts ...FilterOption) *Filter {
+	return NewFilterPow(getBucketPow(capacity), opts...)
+}
+
+// NewFilterReport returns a new cuckoofilter like NewFilter, along with
+// its actual capacity after rounding, e.g. 1024 for a capacity of 1000
+func NewFilterReport(capacity uint, opts ...FilterOption) (*Filter, uint) {
+	cf := NewFilter(capacity, opts...)
+	return cf, cf.Capacity()
+}
+
+// NewFilterWithSource returns a new cuckoofilter with a given capacity
+// whose evictions draw from src, see WithRandSource. Together with
+// EncodeCanonical it gives byte-identical output for a fixed seed and
+// sequence of inserts, e.g. for golden files in tests.
+func NewFilterWithSource(capacity uint, src rand.Source, opts ...FilterOption) *Filter {
+	return NewFilter(capacity, append([]FilterOption{WithRandSource(src)}, opts...)...)
+}
+
+// NewFilterPow returns a new cuckoofilter with exactly 2^bucketPow buckets.
+// With a bucketPow of 0 every item shares the single bucket, so the filter
+// holds at most bucketSize items and a failed insert evicts nothing.
+// It panics if bucketPow exceeds maxBucketPow (32 on 64-bit platforms, 28
+// on 32-bit ones).
+func NewFilterPow(bucketPow uint, opts ...FilterOption) *Filter {
+	if bucketPow > maxBucketPow {
+		panic(fmt.Sprintf("cuckoo: bucketPow %d exceeds maximum %d", bucketPow, maxBucketPow))
 	}
-	buckets := make([]bucket, capacity)
-	return &Filter{
+	buckets := make([]bucket, 1<<bucketPow)
+	cf := &Filter{
 		Buckets:   buckets,
 		Count:     0,
-		BucketPow: uint(bits.TrailingZeros(capacity)),
+		BucketPow: bucketPow,
 	}
+	for _, opt := range opts {
+		opt(cf)
+	}
+	if cf.maxKicks > 0 {
+		// every failing insert needs the scratch space, allocate it once
+		cf.kickSlots = make([]uint8, cf.maxKicks)
+	}
+	return cf
 }
 
 func CopyFilter(buckets []bucket, count uint, bucketPow uint) *Filter {
 	newBucket := make([]bucket, len(buckets))
 	copy(newBucket, buckets)
-	return &Filter{
+	cf := &Filter{
 		Buckets : newBucket,
 		Count: count,
 		BucketPow: bucketPow,
 	}
+	cf.setOccupied(countOccupied(newBucket))
+	return cf
+}
+
+// MakeFingerprint validates b as a fingerprint. Zero marks an empty slot
+// and is rejected.
+func MakeFingerprint(b byte) (byte, error) {
+	if b == nullFp {
+		return 0, fmt.Errorf("fingerprint can not be %d", nullFp)
+	}
+	return b, nil
+}
+
+// NewFilterFromBuckets returns a Cuckoofilter with 2^pow buckets holding the
+// fingerprints in data, bucketSize bytes per bucket with 0 marking an empty
+// slot. It is meant for building exact bucket layouts in tests.
+func NewFilterFromBuckets(data []byte, count, pow uint) (*Filter, error) {
+	if pow > maxBucketPow {
+		return nil, fmt.Errorf("bucketPow %d exceeds maximum %d", pow, maxBucketPow)
+	}
+	if expected := bucketSize << pow; len(data) != expected {
+		return nil, fmt.Errorf("expected %d bytes for bucketPow %d, got %d", expected, pow, len(data))
+	}
+	cf := NewFilterPow(pow)
+	for i := range cf.Buckets {
+		for j := range cf.Buckets[i] {
+			cf.Buckets[i][j] = fingerprint(data[i*bucketSize+j])
+		}
+	}
+	cf.Count = count
+	cf.setOccupied(countOccupied(cf.Buckets))
+	return cf, nil
 }
 
-// Lookup returns true if data is in the counter
+// Lookup returns true if data is in the counter. It does not retain data or
+// allocate, so a buffer refilled for every call can be reused safely. As
+// data is handed to the key transform, if any, the compiler assumes it
+// escapes: a stack buffer passed to Lookup is moved to the heap once, not
+// per call.
 func (cf *Filter) Lookup(data []byte) bool {
-	i1, fp := getIndexAndFingerprint(data, cf.BucketPow)
+	i1, fp := cf.getIndexAndFingerprint(data)
+	return cf.contains(fp, i1)
+}
+
+// contains returns whether fp is stored in bucket i1 or its alternate
+func (cf *Filter) contains(fp fingerprint, i1 uint) bool {
 	if cf.Buckets[i1].getFingerprintIndex(fp) > -1 {
 		return true
 	}
@@ -51,12 +269,291 @@ func (cf *Filter) Lookup(data []byte) bool {
 	return cf.Buckets[i2].getFingerprintIndex(fp) > -1
 }
 
+// CandidateIndices returns the two buckets data's fingerprint can be stored
+// in, which are equal when the alternate bucket is the primary one
+func (cf *Filter) CandidateIndices(data []byte) (uint, uint) {
+	i1, fp := cf.getIndexAndFingerprint(data)
+	return i1, getAltIndex(fp, i1, cf.BucketPow)
+}
+
+// InsertPressure returns how many free slots remain in each of data's
+// candidate buckets. Low values warn that inserting data will evict; the
+// same bucket is counted twice when both candidates coincide.
+func (cf *Filter) InsertPressure(data []byte) (primaryFree, altFree int) {
+	i1, i2 := cf.CandidateIndices(data)
+	return bucketSize - int(cf.Buckets[i1].occupied()), bucketSize - int(cf.Buckets[i2].occupied())
+}
+
+// LookupLocation returns where data's fingerprint is stored in the counter.
+// If data is not found it returns false, 0 and -1.
+func (cf *Filter) LookupLocation(data []byte) (found bool, bucketIndex uint, slot int) {
+	i1, fp := cf.getIndexAndFingerprint(data)
+	if j := cf.Buckets[i1].getFingerprintIndex(fp); j > -1 {
+		return true, i1, j
+	}
+	i2 := getAltIndex(fp, i1, cf.BucketPow)
+	if j := cf.Buckets[i2].getFingerprintIndex(fp); j > -1 {
+		return true, i2, j
+	}
+	return false, 0, -1
+}
+
+// CountMatches returns how many slots of data's candidate buckets hold its
+// fingerprint. More than one means data was inserted several times or
+// another item shares its fingerprint and buckets.
+func (cf *Filter) CountMatches(data []byte) int {
+	i1, fp := cf.getIndexAndFingerprint(data)
+	n := cf.Buckets[i1].countFingerprint(fp)
+	if i2 := getAltIndex(fp, i1, cf.BucketPow); i2 != i1 {
+		n += cf.Buckets[i2].countFingerprint(fp)
+	}
+	return n
+}
+
+// LookupCount returns how many of items are in the counter. Duplicate
+// items are looked up and counted every time they occur.
+func (cf *Filter) LookupCount(items [][]byte) int {
+	var n int
+	for _, data := range items {
+		if cf.Lookup(data) {
+			n++
+		}
+	}
+	return n
+}
+
+// FirstAbsent returns the index of the first of items not in the counter
+// and true, stopping there, or -1 and false if all of them are present
+func (cf *Filter) FirstAbsent(items [][]byte) (index int, found bool) {
+	for i, data := range items {
+		if !cf.Lookup(data) {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// LookupStream looks up every key received from in and sends the results,
+// in order, on the returned channel, which is closed once in is closed.
+// The counter must not be modified while the stream is running.
+func (cf *Filter) LookupStream(in <-chan []byte) <-chan bool {
+	out := make(chan bool)
+	go func() {
+		defer close(out)
+		for data := range in {
+			out <- cf.Lookup(data)
+		}
+	}()
+	return out
+}
+
+// LookupTiered returns true if data is in any of the filters, checking them
+// in order and stopping at the first hit
+func LookupTiered(data []byte, filters ...*Filter) bool {
+	for _, filter := range filters {
+		if filter.Lookup(data) {
+			return true
+		}
+	}
+	return false
+}
+
+// AgreeOn returns the keys that a and b disagree on, i.e. that only one of
+// them reports present. Unlike comparing encodings it works for filters
+// built with different parameters.
+func AgreeOn(a, b *Filter, keys [][]byte) (disagreements [][]byte) {
+	for _, data := range keys {
+		if a.Lookup(data) != b.Lookup(data) {
+			disagreements = append(disagreements, data)
+		}
+	}
+	return disagreements
+}
+
+// Set is a minimal set of byte keys, so a Filter can be swapped with other
+// set implementations
+type Set interface {
+	Add(data []byte) bool
+	Contains(data []byte) bool
+	Remove(data []byte) bool
+}
+
+var _ Set = (*Filter)(nil)
+
+// Membership is an approximate membership structure, so filters can be
+// chained with each other and with other structures
+type Membership interface {
+	Lookup(data []byte) bool
+	CountEntries() uint
+}
+
+var (
+	_ Membership = (*Filter)(nil)
+	_ Membership = (*ScalableCuckooFilter)(nil)
+	_ Membership = (*DecayingFilter)(nil)
+	_ Membership = (*ImmutableFilter)(nil)
+	_ Membership = (*StripedFilter)(nil)
+	_ Membership = (*SafeFilter)(nil)
+	_ Membership = (*CachedFilter)(nil)
+	_ Membership = (*AdaptiveFilter)(nil)
+	_ Membership = (*DoubleFingerprintFilter)(nil)
+	_ Membership = (*FilterSet)(nil)
+)
+
+// Add inserts data into the counter, see Insert
+func (cf *Filter) Add(data []byte) bool {
+	return cf.Insert(data)
+}
+
+// Contains returns true if data is in the counter, see Lookup
+func (cf *Filter) Contains(data []byte) bool {
+	return cf.Lookup(data)
+}
+
+// Remove deletes data from the counter, see Delete
+func (cf *Filter) Remove(data []byte) bool {
+	return cf.Delete(data)
+}
+
+// Rebalance moves fingerprints from fuller buckets into emptier alternate
+// buckets and returns how many it moved. A fingerprint does not record
+// which of its two buckets is the primary one, so instead of moving items
+// home it evens out occupancy, which leaves fewer full buckets and lets
+// more later inserts succeed without evictions. Membership is unchanged.
+func (cf *Filter) Rebalance() int {
+	var moved int
+	for changed := true; changed; {
+		changed = false
+		for i := range cf.Buckets {
+			for j, fp := range cf.Buckets[i] {
+				if fp == nullFp {
+					continue
+				}
+				alt := getAltIndex(fp, uint(i), cf.BucketPow)
+				if cf.Buckets[alt].occupied()+1 < cf.Buckets[i].occupied() {
+					cf.Buckets[i][j] = nullFp
+					cf.Buckets[alt].insert(fp)
+					moved++
+					changed = true
+				}
+			}
+		}
+	}
+	return moved
+}
+
+// Clone returns a deep copy of the counter with the same options. A source
+// set with WithRandSource is not shared; the clone evicts using the global
+// source of math/rand.
+func (cf *Filter) Clone() *Filter {
+	clone := *cf
+	clone.Buckets = make([]bucket, len(cf.Buckets))
+	copy(clone.Buckets, cf.Buckets)
+	if cf.evictions != nil {
+		clone.evictions = make(map[int]int, len(cf.evictions))
+		for n, count := range cf.evictions {
+			clone.evictions[n] = count
+		}
+	}
+	clone.kickSlots = nil
+	clone.rng = nil
+	return &clone
+}
+
+// Compact returns a new counter holding the same fingerprints in the
+// fewest buckets that keep its load below DefaultLoadFactor, and never more
+// buckets than cf. Fingerprints can not be rehashed, but halving the number
+// of buckets only drops high index bits, so every fingerprint keeps a valid
+// pair of candidate buckets. Options and Tag carry over; cf is unchanged.
+// It also returns the bytes reclaimed, cf's MemoryUsage minus that of the
+// new counter.
+func (cf *Filter) Compact() (*Filter, int) {
+	compacted := cf.compact()
+	return compacted, int(cf.MemoryUsage()) - int(compacted.MemoryUsage())
+}
+
+func (cf *Filter) compact() *Filter {
+	pow := getBucketPow(uint(math.Ceil(float64(cf.OccupiedSlots()) / DefaultLoadFactor)))
+	for ; pow < cf.BucketPow; pow++ {
+		if compacted, ok := cf.rehome(pow); ok {
+			return compacted
+		}
+	}
+	if compacted, ok := cf.rehome(cf.BucketPow); ok {
+		return compacted
+	}
+	// at cf's size every fingerprint is first tried in its own bucket, so
+	// rehoming fits, but a copy of cf is a safe fallback if it ever does not
+	return cf.Clone()
+}
+
+// MemoryUsage returns the number of bytes taken by the counter's buckets
+func (cf *Filter) MemoryUsage() uint64 {
+	return uint64(len(cf.Buckets)) * bucketSize
+}
+
+// rehome returns a counter with 2^pow buckets, at most cf.BucketPow,
+// holding cf's fingerprints, and whether all of them fit
+func (cf *Filter) rehome(pow uint) (*Filter, bool) {
+	compacted := cf.emptyLike(pow)
+	compacted.Deletions = cf.Deletions
+	compacted.deleted, compacted.lost = cf.deleted, cf.lost
+	mask := masks[pow]
+	for i, b := range cf.Buckets {
+		for _, fp := range b {
+			if fp == nullFp {
+				continue
+			}
+			if ok, _, _ := compacted.insertFingerprint(fp, uint(i)&mask); !ok {
+				return nil, false
+			}
+		}
+	}
+	return compacted, true
+}
+
+// NewEmptyLike returns an empty counter with the same BucketPow, options
+// and Tag as cf, e.g. for double buffering. A source set with
+// WithRandSource is not shared, and Deletions starts at 0.
+func (cf *Filter) NewEmptyLike() *Filter {
+	empty := cf.emptyLike(cf.BucketPow)
+	if cf.evictions != nil {
+		empty.evictions = make(map[int]int)
+	}
+	return empty
+}
+
+// emptyLike returns an empty counter with 2^pow buckets and the options
+// and Tag of cf
+func (cf *Filter) emptyLike(pow uint) *Filter {
+	empty := NewFilterPow(pow)
+	empty.Tag = cf.Tag
+	empty.keyTransform = cf.keyTransform
+	empty.victimPolicy = cf.victimPolicy
+	empty.maxKicks = cf.maxKicks
+	empty.salt = cf.salt
+	empty.collapseDuplicates = cf.collapseDuplicates
+	empty.deletionsInHeader = cf.deletionsInHeader
+	return empty
+}
+
 // Reset ...
 func (cf *Filter) Reset() {
 	for i := range cf.Buckets {
 		cf.Buckets[i].reset()
 	}
 	cf.Count = 0
+	cf.skew = 0
+	cf.deleted = false
+	cf.lost = false
+	cf.maxChain = 0
+}
+
+func (cf *Filter) getIndexAndFingerprint(data []byte) (uint, fingerprint) {
+	if cf.keyTransform != nil {
+		data = cf.keyTransform(data)
+	}
+	return getSaltedIndexAndFingerprint(data, cf.BucketPow, cf.salt)
 }
 
 func randi(i1, i2 uint) uint {
@@ -66,17 +563,113 @@ func randi(i1, i2 uint) uint {
 	return i2
 }
 
+func (cf *Filter) intn(n int) int {
+	if cf.rng != nil {
+		return cf.rng.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+// victimBucket returns the candidate bucket to start evicting from
+func (cf *Filter) victimBucket(i1, i2 uint) uint {
+	if cf.victimPolicy == VictimRandom {
+		if cf.intn(2) == 0 {
+			return i1
+		}
+		return i2
+	}
+	return i1
+}
+
+// victimSlot returns the slot to evict from a full bucket
+func (cf *Filter) victimSlot() int {
+	switch cf.victimPolicy {
+	case VictimRoundRobin:
+		j := cf.victimNext
+		cf.victimNext = (j + 1) % bucketSize
+		return j
+	case VictimFirstSlot:
+		return 0
+	default:
+		return cf.intn(bucketSize)
+	}
+}
+
 // Insert inserts data into the counter and returns true upon success
 func (cf *Filter) Insert(data []byte) bool {
-	i1, fp := getIndexAndFingerprint(data, cf.BucketPow)
-	if cf.insert(fp, i1) {
+	ok, _, _ := cf.InsertSpill(data)
+	return ok
+}
+
+// InsertSpill inserts data into the counter like Insert. When the eviction
+// chain fails, it also returns the fingerprint and last bucket index of the
+// element that was displaced and could not be rehomed; that element is no
+// longer stored in the counter. With WithMaxKicks that is always data's own
+// fingerprint and primary bucket.
+func (cf *Filter) InsertSpill(data []byte) (ok bool, spilledFp byte, spilledIndex uint) {
+	i1, fp := cf.getIndexAndFingerprint(data)
+	if cf.collapses(fp, i1) {
+		return true, 0, 0
+	}
+	ok, fp, i := cf.insertFingerprint(fp, i1)
+	return ok, byte(fp), i
+}
+
+// collapses returns whether storing fp with primary bucket i1 is skipped
+// under WithCollapseDuplicates, as fp is already stored
+func (cf *Filter) collapses(fp fingerprint, i1 uint) bool {
+	return cf.collapseDuplicates && cf.contains(fp, i1)
+}
+
+// insertFingerprint stores fp in bucket i1 or its alternate, evicting as
+// needed. On failure it returns the fingerprint left homeless and the
+// bucket it last tried.
+func (cf *Filter) insertFingerprint(fp fingerprint, i1 uint) (bool, fingerprint, uint) {
+	i2, ok := cf.insertDirect(fp, i1)
+	if ok {
+		return true, 0, 0
+	}
+	if cf.BucketPow == 0 {
+		// there is no other bucket to evict to
+		cf.recordEvictions(0)
+		return false, fp, i1
+	}
+	if cf.maxKicks > 0 {
+		if cf.reinsertBounded(fp, cf.victimBucket(i1, i2), cf.maxKicks) {
+			return true, 0, 0
+		}
+		return false, fp, i1
+	}
+	return cf.reinsert(fp, cf.victimBucket(i1, i2))
+}
+
+// insertFingerprintOrUndo stores fp like insertFingerprint, but undoes the
+// evictions of a failed insert so no other fingerprint is lost
+func (cf *Filter) insertFingerprintOrUndo(fp fingerprint, i1 uint) bool {
+	i2, ok := cf.insertDirect(fp, i1)
+	if ok {
 		return true
 	}
+	if cf.BucketPow == 0 {
+		cf.recordEvictions(0)
+		return false
+	}
+	return cf.reinsertBounded(fp, cf.victimBucket(i1, i2), cf.kickLimit())
+}
+
+// insertDirect stores fp in bucket i1 or its alternate without evicting,
+// returning the alternate
+func (cf *Filter) insertDirect(fp fingerprint, i1 uint) (uint, bool) {
+	if cf.insert(fp, i1) {
+		cf.recordEvictions(0)
+		return 0, true
+	}
 	i2 := getAltIndex(fp, i1, cf.BucketPow)
 	if cf.insert(fp, i2) {
-		return true
+		cf.recordEvictions(0)
+		return 0, true
 	}
-	return cf.reinsert(fp, randi(i1, i2))
+	return i2, false
 }
 
 // InsertUnique inserts data into the counter if not exists and returns true upon success
@@ -87,6 +680,14 @@ func (cf *Filter) InsertUnique(data []byte) bool {
 	return cf.Insert(data)
 }
 
+// InsertAssumeNew inserts data like Insert, for callers that guarantee
+// data has not been inserted before, e.g. because it comes from a deduped
+// source. It skips the presence check of InsertUnique; inserting a key that
+// is already present stores it twice.
+func (cf *Filter) InsertAssumeNew(data []byte) bool {
+	return cf.Insert(data)
+}
+
 func (cf *Filter) insert(fp fingerprint, i uint) bool {
 	if cf.Buckets[i].insert(fp) {
 		cf.Count++
@@ -95,9 +696,11 @@ func (cf *Filter) insert(fp fingerprint, i uint) bool {
 	return false
 }
 
-func (cf *Filter) reinsert(fp fingerprint, i uint) bool {
+// reinsert kicks fingerprints around until fp finds a home. On failure it
+// returns the fingerprint left homeless and the bucket it last tried.
+func (cf *Filter) reinsert(fp fingerprint, i uint) (bool, fingerprint, uint) {
 	for k := 0; k < maxCuckooCount; k++ {
-		j := rand.Intn(bucketSize)
+		j := cf.victimSlot()
 		oldfp := fp
 		fp = cf.Buckets[i][j]
 		cf.Buckets[i][j] = oldfp
@@ -105,15 +708,79 @@ func (cf *Filter) reinsert(fp fingerprint, i uint) bool {
 		// look in the alternate location for that random element
 		i = getAltIndex(fp, i, cf.BucketPow)
 		if cf.insert(fp, i) {
+			cf.recordEvictions(k + 1)
+			return true, nullFp, 0
+		}
+	}
+	cf.recordEvictions(maxCuckooCount)
+	cf.lost = true
+	return false, fp, i
+}
+
+// reinsertBounded kicks fingerprints around like reinsert, at most limit
+// times. On failure it undoes every eviction, leaving fp unstored.
+func (cf *Filter) reinsertBounded(fp fingerprint, i uint, limit int) bool {
+	if len(cf.kickSlots) < limit {
+		cf.kickSlots = make([]uint8, limit)
+	}
+	for k := 0; k < limit; k++ {
+		j := cf.victimSlot()
+		cf.kickSlots[k] = uint8(j)
+		fp, cf.Buckets[i][j] = cf.Buckets[i][j], fp
+		i = getAltIndex(fp, i, cf.BucketPow)
+		if cf.insert(fp, i) {
+			cf.recordEvictions(k + 1)
 			return true
 		}
 	}
+	// Walk the chain backwards: fp was evicted from the alternate of the
+	// bucket it is homeless at, where it displaced its predecessor.
+	for k := limit - 1; k >= 0; k-- {
+		i = getAltIndex(fp, i, cf.BucketPow)
+		j := int(cf.kickSlots[k])
+		fp, cf.Buckets[i][j] = cf.Buckets[i][j], fp
+	}
+	cf.recordEvictions(limit)
 	return false
 }
 
-// Delete data from counter if exists and return if deleted or not
+func (cf *Filter) recordEvictions(n int) {
+	if n > cf.maxChain {
+		cf.maxChain = n
+	}
+	if cf.evictions != nil {
+		cf.evictions[n]++
+	}
+}
+
+// MaxEvictionChain returns the most evictions a single insert has needed
+// since the counter was created or Reset. Failed inserts count at the
+// eviction limit, so reaching Params().MaxKicks means an insert has failed.
+func (cf *Filter) MaxEvictionChain() int {
+	return cf.maxChain
+}
+
+// EvictionHistogram returns how many inserts needed a given number of
+// evictions, failed inserts being counted at the eviction limit (500 unless
+// set with WithMaxKicks). It returns nil
+// unless the filter was created with WithEvictionHistogram.
+func (cf *Filter) EvictionHistogram() map[int]int {
+	if cf.evictions == nil {
+		return nil
+	}
+	histogram := make(map[int]int, len(cf.evictions))
+	for n, count := range cf.evictions {
+		histogram[n] = count
+	}
+	return histogram
+}
+
+// Delete data from counter if exists and return if deleted or not.
+// Each call removes at most one stored copy, so data inserted n times needs
+// n deletes; deleting data that is not stored is a no-op returning false
+// and Count never drops below zero.
 func (cf *Filter) Delete(data []byte) bool {
-	i1, fp := getIndexAndFingerprint(data, cf.BucketPow)
+	i1, fp := cf.getIndexAndFingerprint(data)
 	if cf.delete(fp, i1) {
 		return true
 	}
@@ -121,55 +788,763 @@ func (cf *Filter) Delete(data []byte) bool {
 	return cf.delete(fp, i2)
 }
 
+// Merge inserts every fingerprint stored in other, which must have the same
+// parameters and salt, into the counter; otherwise it returns
+// ErrIncompatibleParams. Items stored in both end up stored twice. If
+// the counter fills up, Merge stops and returns an error with the items
+// merged so far left in place; items stored before the merge are never
+// evicted.
+func (cf *Filter) Merge(other *Filter) error {
+	return cf.merge(other, false)
+}
+
+// MergeUnique merges other into the counter like Merge, skipping every
+// fingerprint already stored in its candidate buckets. Shared items are
+// then stored once, keeping Count close to the number of distinct items,
+// at the cost of also skipping distinct items whose fingerprints collide.
+func (cf *Filter) MergeUnique(other *Filter) error {
+	return cf.merge(other, true)
+}
+
+func (cf *Filter) merge(other *Filter, unique bool) error {
+	if err := compatible(cf, other); err != nil {
+		return err
+	}
+	for i, b := range other.Buckets {
+		for _, fp := range b {
+			if fp == nullFp {
+				continue
+			}
+			i := uint(i)
+			if unique && (cf.Buckets[i].getFingerprintIndex(fp) != -1 ||
+				cf.Buckets[getAltIndex(fp, i, cf.BucketPow)].getFingerprintIndex(fp) != -1) {
+				continue
+			}
+			if !cf.insertFingerprintOrUndo(fp, i) {
+				return fmt.Errorf("failed to merge, filter is full")
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteAt removes one copy of fingerprint fp from bucket index or its
+// alternate, for callers that know where an item lives but not its key. It
+// returns false if fp is not a valid fingerprint, index is out of range or
+// neither bucket holds fp.
+func (cf *Filter) DeleteAt(fp byte, index uint) bool {
+	if fp == nullFp || index >= uint(len(cf.Buckets)) {
+		return false
+	}
+	if cf.delete(fingerprint(fp), index) {
+		return true
+	}
+	return cf.delete(fingerprint(fp), getAltIndex(fingerprint(fp), index, cf.BucketPow))
+}
+
+// InsertBatch inserts every item into the counter and returns how many
+// were inserted
+func (cf *Filter) InsertBatch(items [][]byte) int {
+	var inserted int
+	for _, data := range items {
+		if cf.Insert(data) {
+			inserted++
+		}
+	}
+	return inserted
+}
+
+// InsertBatchCollect inserts every item into the counter and returns how
+// many were inserted along with the items that did not fit. Unlike Insert,
+// a failed insert undoes its evictions, so the failed items are exactly the
+// ones not stored and every inserted item stays in the counter.
+func (cf *Filter) InsertBatchCollect(items [][]byte) (inserted int, failed [][]byte) {
+	for _, data := range items {
+		i1, fp := cf.getIndexAndFingerprint(data)
+		if cf.collapses(fp, i1) || cf.insertFingerprintOrUndo(fp, i1) {
+			inserted++
+		} else {
+			failed = append(failed, data)
+		}
+	}
+	return inserted, failed
+}
+
+// EstimateBatchEvictions returns how many evictions inserting items would
+// cause, by inserting them into a Clone. A failed insert counts as the
+// eviction limit. With VictimRandom the evictions are random, so the
+// estimate varies between calls; the counter itself is not modified.
+func (cf *Filter) EstimateBatchEvictions(items [][]byte) int {
+	clone := cf.Clone()
+	clone.evictions = make(map[int]int)
+	clone.InsertBatch(items)
+	var evictions int
+	for n, count := range clone.evictions {
+		evictions += n * count
+	}
+	return evictions
+}
+
+// DeleteBatch deletes every item from the counter and returns how many
+// were found and deleted
+func (cf *Filter) DeleteBatch(items [][]byte) int {
+	var deleted int
+	for _, data := range items {
+		if cf.Delete(data) {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// delete removes fp from bucket i, adjusting Count only once the bucket is
+// confirmed to hold one fingerprint less, so Count can not drift from the
+// occupied slots whatever bucket.delete reports
 func (cf *Filter) delete(fp fingerprint, i uint) bool {
-	if cf.Buckets[i].delete(fp) {
+	b := &cf.Buckets[i]
+	before := b.occupied()
+	if b.delete(fp) && b.occupied() == before-1 {
 		if cf.Count > 0 {
 			cf.Count--
+		} else {
+			cf.skew--
 		}
+		cf.Deletions++
+		cf.deleted = true
 		return true
 	}
 	return false
 }
 
+// DeletionsCount returns the number of fingerprints deleted over the
+// counter's lifetime
+func (cf *Filter) DeletionsCount() uint {
+	return cf.Deletions
+}
+
+// DeletionsPerformed returns whether a fingerprint has been deleted since
+// the counter was created or last Reset; a deletion may have removed a
+// fingerprint shared with another item. It does not cover failed inserts,
+// which may also drop a stored fingerprint, see FalseNegativesPossible.
+func (cf *Filter) DeletionsPerformed() bool {
+	return cf.deleted
+}
+
+// FalseNegativesPossible returns whether Lookup may return false for an
+// item that was successfully inserted since the counter was created or
+// last Reset, because a fingerprint was deleted or an insert failed after
+// its eviction chain displaced a stored fingerprint. Inserts bounded with
+// WithMaxKicks undo their evictions and never drop one.
+func (cf *Filter) FalseNegativesPossible() bool {
+	return cf.deleted || cf.lost
+}
+
 // Count returns the number of items in the counter
 func (cf *Filter) CountEntries() uint {
 	return cf.Count
 }
 
+// cells returns how many times each fingerprint is stored per pair of
+// candidate buckets. A cell is identified by the fingerprint and the lower
+// bucket index of the pair, so it does not depend on which of the two
+// buckets an eviction left the fingerprint in.
+func (cf *Filter) cells() map[uint64]uint {
+	cells := make(map[uint64]uint)
+	for i, b := range cf.Buckets {
+		for _, fp := range b {
+			if fp == nullFp {
+				continue
+			}
+			cells[cell(fp, uint(i), cf.BucketPow)]++
+		}
+	}
+	return cells
+}
+
+// cell returns the cell, as used by cells, of fingerprint fp stored in
+// bucket i
+func cell(fp fingerprint, i, bucketPow uint) uint64 {
+	if j := getAltIndex(fp, i, bucketPow); j < i {
+		i = j
+	}
+	return uint64(i)<<8 | uint64(fp)
+}
+
+// FindCollisions returns the groups of keys that a filter with 2^bucketPow
+// buckets can not tell apart: keys in a group share their fingerprint and
+// pair of candidate buckets, so each is a false positive for the others and
+// deleting one may delete another. Groups keep the order of keys, and keys
+// without collisions are left out.
+func FindCollisions(keys [][]byte, bucketPow uint) [][][]byte {
+	groups := make(map[uint64]int)
+	var collisions [][][]byte
+	for _, key := range keys {
+		i, fp := getIndexAndFingerprint(key, bucketPow)
+		c := cell(fp, i, bucketPow)
+		if g, ok := groups[c]; ok {
+			collisions[g] = append(collisions[g], key)
+			continue
+		}
+		groups[c] = len(collisions)
+		collisions = append(collisions, [][]byte{key})
+	}
+	n := 0
+	for _, group := range collisions {
+		if len(group) > 1 {
+			collisions[n] = group
+			n++
+		}
+	}
+	return collisions[:n]
+}
+
+// EstimateDistinct returns an approximate number of distinct items in the
+// counter. Unlike Count it is not inflated by inserting the same item
+// repeatedly: fingerprints stored more than once for the same pair of
+// candidate buckets are counted once, and the result is corrected for
+// distinct items that collide on both fingerprint and buckets.
+func (cf *Filter) EstimateDistinct() float64 {
+	seen := cf.cells()
+
+	// Every fingerprint splits the buckets into pairs (or single buckets
+	// when its alternate index is the same), each pair being one cell.
+	var cells float64
+	for fp := 1; fp < 256; fp++ {
+		if getAltIndex(fingerprint(fp), 0, cf.BucketPow) == 0 {
+			cells += float64(len(cf.Buckets))
+		} else {
+			cells += float64(len(cf.Buckets)) / 2
+		}
+	}
+	used := float64(len(seen))
+	if used >= cells {
+		return used
+	}
+	return -cells * math.Log(1-used/cells)
+}
+
+// SymmetricDiffCount returns how many stored fingerprints differ between
+// the counter and other, which must have the same parameters and salt
+// like for Merge. Fingerprints
+// are compared per pair of candidate buckets, so items placed differently
+// by evictions still match, while distinct items that collide on both
+// fingerprint and buckets are indistinguishable and lower the count.
+func (cf *Filter) SymmetricDiffCount(other *Filter) (uint, error) {
+	if err := compatible(cf, other); err != nil {
+		return 0, err
+	}
+	cells, otherCells := cf.cells(), other.cells()
+	var diff uint
+	for cell, n := range cells {
+		m := otherCells[cell]
+		if n > m {
+			diff += n - m
+		} else {
+			diff += m - n
+		}
+	}
+	for cell, m := range otherCells {
+		if _, ok := cells[cell]; !ok {
+			diff += m
+		}
+	}
+	return diff, nil
+}
+
+// JaccardEstimate returns an estimate of the Jaccard index |A∩B| / |A∪B|
+// of the items in a and b, which must have the same BucketPow and salt.
+// Fingerprints are compared per pair of candidate buckets like in
+// SymmetricDiffCount, so distinct items that collide on both count as
+// shared and raise the estimate. Two empty filters are identical and have
+// an index of 1.
+func JaccardEstimate(a, b *Filter) (float64, error) {
+	if err := compatible(a, b); err != nil {
+		return 0, err
+	}
+	cellsA, cellsB := a.cells(), b.cells()
+	var intersection, union uint
+	for cell, n := range cellsA {
+		m := cellsB[cell]
+		if n < m {
+			intersection += n
+			union += m
+		} else {
+			intersection += m
+			union += n
+		}
+	}
+	for cell, m := range cellsB {
+		if _, ok := cellsA[cell]; !ok {
+			union += m
+		}
+	}
+	if union == 0 {
+		return 1, nil
+	}
+	return float64(intersection) / float64(union), nil
+}
+
+// SlotInfo describes an occupied slot: its fingerprint, the bucket and
+// slot it is stored in and that fingerprint's alternate bucket
+type SlotInfo struct {
+	Fingerprint byte
+	BucketA     uint
+	BucketB     uint
+	Slot        int
+}
+
+// DumpSlots returns a SlotInfo for every occupied slot in the counter
+func (cf *Filter) DumpSlots() []SlotInfo {
+	slots := make([]SlotInfo, 0, cf.Count)
+	cf.eachSlot(func(slot SlotInfo) bool {
+		slots = append(slots, slot)
+		return true
+	})
+	return slots
+}
+
+// Drain sends a SlotInfo for every occupied slot in the counter, in bucket
+// order, on the returned channel and closes it when done, so the contents
+// can be consumed concurrently without building a slice. Despite its name
+// it leaves the counter untouched. The counter must not be modified until
+// the channel is closed. A consumer that stops reading early must close
+// done, which stops the sending goroutine and closes the channel; done may
+// be nil if the channel is always read to the end.
+func (cf *Filter) Drain(done <-chan struct{}) <-chan SlotInfo {
+	out := make(chan SlotInfo, bucketSize)
+	go func() {
+		defer close(out)
+		cf.eachSlot(func(slot SlotInfo) bool {
+			select {
+			case out <- slot:
+				return true
+			case <-done:
+				return false
+			}
+		})
+	}()
+	return out
+}
+
+// OccupiedPositions returns the flat positions bucketIndex*bucketSize+slot
+// of the occupied slots in ascending order, e.g. for loading into a roaring
+// bitmap. Positions must fit in 32 bits, so it panics for filters with a
+// BucketPow above 30.
+func (cf *Filter) OccupiedPositions() []uint32 {
+	if cf.BucketPow > 30 {
+		panic(fmt.Sprintf("cuckoo: bucketPow %d has positions beyond 32 bits", cf.BucketPow))
+	}
+	positions := make([]uint32, 0, cf.OccupiedSlots())
+	cf.eachSlot(func(slot SlotInfo) bool {
+		positions = append(positions, uint32(slot.BucketA*bucketSize)+uint32(slot.Slot))
+		return true
+	})
+	return positions
+}
+
+// eachSlot calls fn for every occupied slot in bucket order until fn
+// returns false
+func (cf *Filter) eachSlot(fn func(SlotInfo) bool) {
+	for i, b := range cf.Buckets {
+		for j, fp := range b {
+			if fp == nullFp {
+				continue
+			}
+			if !fn(SlotInfo{
+				Fingerprint: byte(fp),
+				BucketA:     uint(i),
+				BucketB:     getAltIndex(fp, uint(i), cf.BucketPow),
+				Slot:        j,
+			}) {
+				return
+			}
+		}
+	}
+}
+
+// FilterParams describes how a filter was built
+type FilterParams struct {
+	BucketSize      int
+	FingerprintBits int
+	BucketPow       uint
+	MaxKicks        int
+}
+
+// ErrIncompatibleParams is returned, wrapped, when combining filters whose
+// fingerprints can not be compared
+var ErrIncompatibleParams = errors.New("incompatible filter parameters")
+
+// compatibleWith returns an error naming the first parameter that keeps
+// fingerprints of filters built with p and q from being combined
+func (p FilterParams) compatibleWith(q FilterParams) error {
+	switch {
+	case p.FingerprintBits != q.FingerprintBits:
+		return fmt.Errorf("%w: FingerprintBits %d and %d", ErrIncompatibleParams, p.FingerprintBits, q.FingerprintBits)
+	case p.BucketSize != q.BucketSize:
+		return fmt.Errorf("%w: BucketSize %d and %d", ErrIncompatibleParams, p.BucketSize, q.BucketSize)
+	case p.BucketPow != q.BucketPow:
+		return fmt.Errorf("%w: BucketPow %d and %d", ErrIncompatibleParams, p.BucketPow, q.BucketPow)
+	}
+	return nil
+}
+
+// compatible returns an error unless a and b store the same keys as the
+// same fingerprints in the same buckets
+func compatible(a, b *Filter) error {
+	if err := a.Params().compatibleWith(b.Params()); err != nil {
+		return err
+	}
+	if a.salt != b.salt {
+		return fmt.Errorf("%w: filters hash with different salts", ErrIncompatibleParams)
+	}
+	return nil
+}
+
+// kickLimit returns the maximum number of evictions per insert
+func (cf *Filter) kickLimit() int {
+	if cf.maxKicks > 0 {
+		return cf.maxKicks
+	}
+	return maxCuckooCount
+}
+
+// Params returns the parameters the counter was built with
+func (cf *Filter) Params() FilterParams {
+	return FilterParams{
+		BucketSize:      bucketSize,
+		FingerprintBits: 8,
+		BucketPow:       cf.BucketPow,
+		MaxKicks:        cf.kickLimit(),
+	}
+}
+
+// Widen always fails: fingerprints are a lossy 8-bit digest of each key, so
+// wider ones can not be derived from them. Lowering the false positive rate
+// requires building a new filter from the original keys.
+func (cf *Filter) Widen() error {
+	return fmt.Errorf("can not widen %d-bit fingerprints without the original keys", cf.Params().FingerprintBits)
+}
+
+// Capacity returns the number of slots, the most items the counter can hold
+func (cf *Filter) Capacity() uint {
+	return uint(len(cf.Buckets)) * bucketSize
+}
+
+// LoadFactor returns the fraction of slots in use
+func (cf *Filter) LoadFactor() float64 {
+	return float64(cf.OccupiedSlots()) / float64(len(cf.Buckets)*bucketSize)
+}
+
+// FalsePositiveRate returns the expected fraction of absent keys Lookup
+// reports present at the current load: a lookup compares against the
+// fingerprints in two buckets, each matching with probability 1/255.
+func (cf *Filter) FalsePositiveRate() float64 {
+	return 1 - math.Pow(1-1.0/255, 2*bucketSize*cf.LoadFactor())
+}
+
+// LookupWithConfidence looks up data like Lookup and returns a confidence
+// in the answer: 1-FalsePositiveRate() when found, which falls as the
+// counter fills, and 1 when not found, as an insert-only counter has no
+// false negatives. It is a rough weight, not the exact probability that a
+// positive is true, which also depends on how many lookups are for absent
+// keys.
+func (cf *Filter) LookupWithConfidence(data []byte) (found bool, confidence float64) {
+	if !cf.Lookup(data) {
+		return false, 1
+	}
+	return true, 1 - cf.FalsePositiveRate()
+}
+
+// MeasureFPR returns the fraction of negativeKeys, which must all be
+// absent from the counter, that Lookup reports present, to check
+// FalsePositiveRate against real data. It returns 0 for no keys.
+func (cf *Filter) MeasureFPR(negativeKeys [][]byte) float64 {
+	if len(negativeKeys) == 0 {
+		return 0
+	}
+	return float64(cf.LookupCount(negativeKeys)) / float64(len(negativeKeys))
+}
+
+// OccupiedSlots returns the number of non-empty slots. Unlike Count it is
+// maintained per slot, so it stays exact when deletes remove fingerprints
+// that collide or encoded counts are wrong, as long as Buckets is only
+// changed through the counter's methods or Count is set to match.
+func (cf *Filter) OccupiedSlots() uint {
+	return uint(int(cf.Count) + cf.skew)
+}
+
+// setOccupied records that n slots are occupied, once Count is set
+func (cf *Filter) setOccupied(n uint) {
+	cf.skew = int(n) - int(cf.Count)
+}
+
+func countOccupied(buckets []bucket) uint {
+	var n uint
+	for i := range buckets {
+		n += buckets[i].occupied()
+	}
+	return n
+}
+
+// String returns a short summary of the counter for debugging
+func (cf *Filter) String() string {
+	return fmt.Sprintf("Filter{buckets=%d pow=%d count=%d load=%.3f}", len(cf.Buckets), cf.BucketPow, cf.Count, cf.LoadFactor())
+}
+
+// BitsPerItem returns the bits of fingerprint storage used per item, or 0
+// for an empty counter. It approaches 8 / LoadFactor.
+func (cf *Filter) BitsPerItem() float64 {
+	if cf.Count == 0 {
+		return 0
+	}
+	return float64(len(cf.Buckets)*bucketSize*8) / float64(cf.Count)
+}
+
+// FillHistogram returns how many buckets have 0, 1, ..., bucketSize
+// occupied slots. Many full buckets warn that inserts will soon fail.
+func (cf *Filter) FillHistogram() []int {
+	histogram := make([]int, bucketSize+1)
+	for i := range cf.Buckets {
+		histogram[cf.Buckets[i].occupied()]++
+	}
+	return histogram
+}
+
+// IndexDistribution hashes samples random keys and returns how many
+// primary bucket indices fell in each of 16 equal ranges of buckets (or one
+// range per bucket for smaller filters), to check the hash for skew. Keys
+// are drawn from the source set with WithRandSource, if any.
+func (cf *Filter) IndexDistribution(samples int) []int {
+	ranges := 16
+	if len(cf.Buckets) < ranges {
+		ranges = len(cf.Buckets)
+	}
+	rng := cf.rng
+	if rng == nil {
+		rng = rand.New(rand.NewSource(rand.Int63()))
+	}
+	histogram := make([]int, ranges)
+	key := make([]byte, 16)
+	for k := 0; k < samples; k++ {
+		binary.LittleEndian.PutUint64(key, rng.Uint64())
+		binary.LittleEndian.PutUint64(key[8:], rng.Uint64())
+		i, _ := cf.getIndexAndFingerprint(key)
+		histogram[uint64(i)*uint64(ranges)/uint64(len(cf.Buckets))]++
+	}
+	return histogram
+}
+
 // Encode returns a byte slice representing a Cuckoofilter
 func (cf *Filter) Encode() []byte {
-	bytes := make([]byte, len(cf.Buckets)*bucketSize)
+	bytes := make([]byte, cf.headerLen()+len(cf.Buckets)*bucketSize+checksumSize)
+	cf.encodeHeader(bytes)
+	payload := bytes[cf.headerLen() : len(bytes)-checksumSize]
 	for i, b := range cf.Buckets {
 		for j, f := range b {
-			index := (i * len(b)) + j
-			bytes[index] = byte(f)
+			index := i*bucketSize + j
+			payload[index] = byte(f)
 		}
 	}
+	putChecksum(bytes)
 	return bytes
 }
 
-// Decode returns a Cuckoofilter from a byte slice
+// EncodeCanonical returns a byte slice representing a Cuckoofilter like
+// Encode, with the fingerprints of each bucket sorted so the output does
+// not depend on the order items were inserted in. Items that overflowed
+// into their alternate bucket in one filter but not in another still make
+// the outputs differ.
+func (cf *Filter) EncodeCanonical() []byte {
+	bytes := cf.Encode()
+	payload := bytes[cf.headerLen() : len(bytes)-checksumSize]
+	for i := 0; i < len(payload); i += bucketSize {
+		b := payload[i : i+bucketSize]
+		for j := 1; j < len(b); j++ {
+			for k := j; k > 0 && b[k] < b[k-1]; k-- {
+				b[k], b[k-1] = b[k-1], b[k]
+			}
+		}
+	}
+	putChecksum(bytes)
+	return bytes
+}
+
+// Decode returns a Cuckoofilter from a byte slice returned by Encode or
+// EncodeSparse, failing with ErrChecksumMismatch if the bytes were
+// corrupted after encoding. Headers are validated, so untrusted input can
+// not claim a Count above the capacity (ErrBadHeader) or a BucketPow that
+// does not match the number of buckets (ErrBadLength). A valid sparse
+// encoding of an empty filter is still only a few bytes whatever its
+// BucketPow, so use DecodeLimited to bound the memory untrusted input can
+// allocate. Legacy encodings without a header, written by earlier versions
+// of this package, are still decoded, unless they are all zeros.
 func Decode(bytes []byte) (*Filter, error) {
-	var count uint
-	if len(bytes)%bucketSize != 0 {
-		return nil, fmt.Errorf("expected bytes to be multiple of %d, got %d", bucketSize, len(bytes))
+	if isSparse(bytes) {
+		return DecodeSparse(bytes)
+	}
+	return decode(bytes, nil)
+}
+
+// decode returns a Cuckoofilter from a byte slice, reusing buckets if it
+// has enough capacity
+func decode(bytes []byte, buckets []bucket) (*Filter, error) {
+	h, payload, err := densePayload(bytes)
+	if err != nil {
+		return nil, err
 	}
-	if len(bytes) == 0 {
-		return nil, fmt.Errorf("bytes can not be empty")
+	if n := 1 << h.bucketPow; cap(buckets) >= n {
+		buckets = buckets[:n]
+	} else {
+		buckets = make([]bucket, n)
 	}
-	buckets := make([]bucket, len(bytes)/4)
 	for i, b := range buckets {
 		for j := range b {
-			index := (i * len(b)) + j
-			if bytes[index] != 0 {
-				buckets[i][j] = fingerprint(bytes[index])
-				count++
-			}
+			index := i*bucketSize + j
+			buckets[i][j] = fingerprint(payload[index])
 		}
 	}
 	return &Filter{
 		Buckets:   buckets,
-		Count:     count,
-		BucketPow: uint(bits.TrailingZeros(uint(len(buckets)))),
+		Count:     h.count,
+		BucketPow: h.bucketPow,
+		Tag:       h.tag,
+		Deletions: h.deletions,
+		deleted:   h.deletions > 0,
+		skew:      int(countOccupied(buckets)) - int(h.count),
+		salt:      h.salt,
+
+		deletionsInHeader: h.hasDeletions,
 	}, nil
 }
+
+// reuseBuckets returns 2^pow empty buckets, reusing buckets if it has
+// enough capacity
+func reuseBuckets(buckets []bucket, pow uint) []bucket {
+	n := 1 << pow
+	if cap(buckets) < n {
+		return make([]bucket, n)
+	}
+	buckets = buckets[:n]
+	for i := range buckets {
+		buckets[i].reset()
+	}
+	return buckets
+}
+
+// densePayload checks the header, length and checksum of an encoding
+// returned by Encode and returns its header and fingerprints
+func densePayload(bytes []byte) (header, []byte, error) {
+	h, err := decodeHeader(bytes)
+	if err != nil {
+		return header{}, nil, err
+	}
+	if h.size == 0 {
+		return h, bytes, nil
+	}
+	payload := bytes[h.size:]
+	if expected := bucketSize<<h.bucketPow + checksumSize; len(payload) != expected {
+		return header{}, nil, fmt.Errorf("%w: expected %d bytes after header, got %d", ErrBadLength, expected, len(payload))
+	}
+	if err := verifyChecksum(bytes); err != nil {
+		return header{}, nil, err
+	}
+	return h, payload[:len(payload)-checksumSize], nil
+}
+
+// DecodeExpecting returns a Cuckoofilter from a byte slice, failing unless
+// it was encoded with the given Tag
+func DecodeExpecting(bytes []byte, tag uint32) (*Filter, error) {
+	h, err := decodeAnyHeader(bytes)
+	if err != nil {
+		return nil, err
+	}
+	if h.tag != tag {
+		return nil, fmt.Errorf("expected tag %d, got %d", tag, h.tag)
+	}
+	return Decode(bytes)
+}
+
+// DecodeLimited returns a Cuckoofilter from a byte slice, refusing to
+// allocate more than maxBuckets buckets
+func DecodeLimited(bytes []byte, maxBuckets int) (*Filter, error) {
+	h, err := decodeAnyHeader(bytes)
+	if err != nil {
+		return nil, err
+	}
+	if n := uint64(1) << h.bucketPow; n > uint64(maxBuckets) {
+		return nil, fmt.Errorf("expected at most %d buckets, got %d", maxBuckets, n)
+	}
+	return Decode(bytes)
+}
+
+// EncodeDiff returns a byte slice holding only the buckets that differ from
+// since, which must have the same number of buckets. Apply it to a copy of
+// since with ApplyDiff.
+func (cf *Filter) EncodeDiff(since *Filter) ([]byte, error) {
+	if len(since.Buckets) != len(cf.Buckets) {
+		return nil, fmt.Errorf("expected %d buckets, got %d", len(cf.Buckets), len(since.Buckets))
+	}
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], uint64(len(cf.Buckets)))
+	bytes := append([]byte(nil), varint[:n]...)
+	last := 0
+	for i, b := range cf.Buckets {
+		if b == since.Buckets[i] {
+			continue
+		}
+		n = binary.PutUvarint(varint[:], uint64(i-last))
+		bytes = append(bytes, varint[:n]...)
+		for _, f := range b {
+			bytes = append(bytes, byte(f))
+		}
+		last = i
+	}
+	return bytes, nil
+}
+
+// ApplyDiff updates the counter with a diff returned by EncodeDiff. The
+// counter is left untouched if the diff is invalid.
+func (cf *Filter) ApplyDiff(diff []byte) error {
+	n, k := binary.Uvarint(diff)
+	if k <= 0 {
+		return fmt.Errorf("invalid diff header")
+	}
+	if n != uint64(len(cf.Buckets)) {
+		return fmt.Errorf("expected diff for %d buckets, got %d", len(cf.Buckets), n)
+	}
+	diff = diff[k:]
+
+	type change struct {
+		i   uint64
+		fps []byte
+	}
+	var changes []change
+	var i uint64
+	for len(diff) > 0 {
+		delta, k := binary.Uvarint(diff)
+		if k <= 0 || len(diff)-k < bucketSize {
+			return fmt.Errorf("truncated diff")
+		}
+		if i += delta; i >= n {
+			return fmt.Errorf("bucket index %d out of range", i)
+		}
+		changes = append(changes, change{i, diff[k : k+bucketSize]})
+		diff = diff[k+bucketSize:]
+	}
+
+	for _, c := range changes {
+		b := &cf.Buckets[c.i]
+		occupied := cf.OccupiedSlots() - b.occupied()
+		if cf.Count >= b.occupied() {
+			cf.Count -= b.occupied()
+		} else {
+			cf.Count = 0
+		}
+		for j := range b {
+			b[j] = fingerprint(c.fps[j])
+		}
+		cf.Count += b.occupied()
+		cf.setOccupied(occupied + b.occupied())
+	}
+	return nil
+}
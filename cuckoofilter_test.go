@@ -2,19 +2,28 @@ package cuckoo
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/rand"
+	"errors"
 	"io"
+	"math"
+	mrand "math/rand"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 func TestInsertion(t *testing.T) {
 	cf := NewFilter(1000000)
 	fd, err := os.Open("/usr/share/dict/words")
 	if err != nil {
-		panic(err)
+		t.Skipf("skipping: %v", err)
 	}
+	defer fd.Close()
 	scanner := bufio.NewScanner(fd)
 
 	var values [][]byte
@@ -27,7 +36,7 @@ func TestInsertion(t *testing.T) {
 		values = append(values, s)
 	}
 
-	count := cf.Count()
+	count := cf.CountEntries()
 	if count != lineCount {
 		t.Errorf("Expected count = %d, instead count = %d", lineCount, count)
 	}
@@ -36,7 +45,7 @@ func TestInsertion(t *testing.T) {
 		cf.Delete(v)
 	}
 
-	count = cf.Count()
+	count = cf.CountEntries()
 	if count != 0 {
 		t.Errorf("Expected count = 0, instead count == %d", count)
 	}
@@ -44,11 +53,14 @@ func TestInsertion(t *testing.T) {
 
 func TestEncodeDecode(t *testing.T) {
 	cf := NewFilter(8)
-	cf.buckets = []bucket{
+	cf.Buckets = []bucket{
 		[4]fingerprint{1, 2, 3, 4},
 		[4]fingerprint{5, 6, 7, 8},
 	}
-	cf.count = 8
+	cf.Count = 8
+	if load := cf.LoadFactor(); load != 1 {
+		t.Errorf("Expected load 1 for directly filled buckets, got %v", load)
+	}
 	bytes := cf.Encode()
 	ncf, err := Decode(bytes)
 	if err != nil {
@@ -61,12 +73,608 @@ func TestEncodeDecode(t *testing.T) {
 
 func TestDecode(t *testing.T) {
 	ncf, err := Decode([]byte(""))
+	if !errors.Is(err, ErrEmptyInput) {
+		t.Errorf("Expected ErrEmptyInput, got %v", err)
+	}
+	if ncf != nil {
+		t.Errorf("Expected nil, got %v", ncf)
+	}
+}
+
+func TestDecodeHeader(t *testing.T) {
+	cf := NewFilter(16)
+	ncf, err := Decode(cf.Encode())
+	if err != nil {
+		t.Errorf("Expected no error for an empty filter, got %v", err)
+	}
+	if !reflect.DeepEqual(cf, ncf) {
+		t.Errorf("Expected %v, got %v", cf, ncf)
+	}
+
+	zeros := make([]byte, len(cf.Encode()))
+	ncf, err = Decode(zeros)
+	if !errors.Is(err, ErrBadHeader) {
+		t.Errorf("Expected corruption error for all-zero input, got %v", err)
+	}
+	if ncf != nil {
+		t.Errorf("Expected nil, got %v", ncf)
+	}
+
+	truncated := cf.Encode()
+	truncated = truncated[:len(truncated)-1]
+	if _, err := Decode(truncated); !errors.Is(err, ErrBadLength) {
+		t.Errorf("Expected ErrBadLength for truncated input, got %v", err)
+	}
+	if _, err := Decode(truncated[:headerSize-1]); !errors.Is(err, ErrBadLength) {
+		t.Errorf("Expected ErrBadLength for truncated header, got %v", err)
+	}
+
+	version := cf.Encode()
+	version[4] = saltVersion + 1
+	if _, err := Decode(version); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("Expected ErrBadHeader for unknown version, got %v", err)
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	cf := NewFilter(64)
+	for i := 0; i < 10; i++ {
+		cf.Insert([]byte("DecodeLegacy_" + strconv.Itoa(i)))
+	}
+	// earlier versions encoded the fingerprints of every bucket only
+	encoded := cf.Encode()
+	legacy := encoded[headerSize : len(encoded)-checksumSize]
+	ncf, err := Decode(legacy)
+	if err != nil {
+		t.Fatalf("Expected no error for a legacy encoding, got %v", err)
+	}
+	if ncf.Count != cf.Count || ncf.BucketPow != cf.BucketPow || !reflect.DeepEqual(ncf.Buckets, cf.Buckets) {
+		t.Errorf("Expected %v, got %v", cf, ncf)
+	}
+	for i := 0; i < 10; i++ {
+		if data := []byte("DecodeLegacy_" + strconv.Itoa(i)); !ncf.Lookup(data) {
+			t.Errorf("Expected %s to be found in a legacy filter", data)
+		}
+	}
+	if !IsValidEncoding(legacy) {
+		t.Errorf("Expected a legacy encoding to be valid")
+	}
+	if _, err := DecodeLimited(legacy, len(cf.Buckets)-1); err == nil {
+		t.Errorf("Expected err for a legacy encoding above the limit, got nil")
+	}
+
+	if _, err := Decode(make([]byte, len(legacy))); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("Expected corruption error for an all-zero legacy encoding, got %v", err)
+	}
+	if _, err := Decode(legacy[:3*bucketSize]); err == nil {
+		t.Errorf("Expected err for a legacy encoding of 3 buckets, got nil")
+	}
+}
+
+func TestDecodeLimited(t *testing.T) {
+	cf := NewFilter(1 << 12)
+	bytes := cf.Encode()
+
+	ncf, err := DecodeLimited(bytes, len(cf.Buckets)-1)
 	if err == nil {
 		t.Errorf("Expected err, got nil")
 	}
 	if ncf != nil {
 		t.Errorf("Expected nil, got %v", ncf)
 	}
+
+	huge := append([]byte(nil), bytes[:headerSize]...)
+	huge[5] = 60
+	ncf, err = DecodeLimited(huge, len(cf.Buckets))
+	if err == nil {
+		t.Errorf("Expected err for a header claiming 2^60 buckets, got nil")
+	}
+	if ncf != nil {
+		t.Errorf("Expected nil, got %v", ncf)
+	}
+
+	ncf, err = DecodeLimited(bytes, len(cf.Buckets))
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(cf, ncf) {
+		t.Errorf("Expected %v, got %v", cf, ncf)
+	}
+}
+
+func TestInsertSpill(t *testing.T) {
+	cf := NewFilter(8)
+	var hash [32]byte
+	for i := 0; i < 100; i++ {
+		io.ReadFull(rand.Reader, hash[:])
+		ok, fp, index := cf.InsertSpill(hash[:])
+		if ok {
+			if fp != 0 || index != 0 {
+				t.Errorf("Expected no spill on success, got fp %d index %d", fp, index)
+			}
+			continue
+		}
+		if fp == 0 {
+			t.Fatalf("Expected a spilled fingerprint, got 0")
+		}
+		if index >= uint(len(cf.Buckets)) {
+			t.Fatalf("Expected spilled index < %d, got %d", len(cf.Buckets), index)
+		}
+		alt := getAltIndex(fingerprint(fp), index, cf.BucketPow)
+		for _, i := range []uint{index, alt} {
+			if cf.Buckets[i].getFingerprintIndex(nullFp) > -1 {
+				t.Errorf("Expected candidate bucket %d of spilled fingerprint to be full", i)
+			}
+		}
+		var occupied uint
+		for _, b := range cf.Buckets {
+			for _, f := range b {
+				if f != nullFp {
+					occupied++
+				}
+			}
+		}
+		if cf.Count != occupied {
+			t.Errorf("Expected count = %d, instead count = %d", occupied, cf.Count)
+		}
+		return
+	}
+	t.Errorf("Expected a spill on a full filter")
+}
+
+func TestKeyTransform(t *testing.T) {
+	nfc := []byte("caf\u00e9")
+	nfd := []byte("cafe\u0301")
+
+	cf := NewFilter(1000, WithKeyTransform(norm.NFC.Bytes))
+	if !cf.Insert(nfd) {
+		t.Fatalf("Expected insert to succeed")
+	}
+	if !cf.Lookup(nfc) {
+		t.Errorf("Expected NFC form to be found after inserting NFD form")
+	}
+	if !cf.Delete(nfc) {
+		t.Errorf("Expected NFC form to delete the NFD form")
+	}
+	if cf.CountEntries() != 0 {
+		t.Errorf("Expected count = 0, instead count == %d", cf.CountEntries())
+	}
+}
+
+func TestEstimateDistinct(t *testing.T) {
+	cf := NewFilter(1 << 16)
+	if est := cf.EstimateDistinct(); est != 0 {
+		t.Errorf("Expected estimate = 0 for an empty filter, got %f", est)
+	}
+
+	const distinct = 40000
+	var hash [32]byte
+	for i := 0; i < distinct; i++ {
+		io.ReadFull(rand.Reader, hash[:])
+		cf.Insert(hash[:])
+		if i%10 == 0 {
+			cf.Insert(hash[:])
+		}
+	}
+
+	est := cf.EstimateDistinct()
+	if math.Abs(est-distinct) > distinct*0.02 {
+		t.Errorf("Expected estimate within 2%% of %d, got %f", distinct, est)
+	}
+}
+
+func TestSet(t *testing.T) {
+	var set Set = NewFilter(1000)
+	key := []byte("geeky ogre")
+	if set.Contains(key) {
+		t.Errorf("Expected %q to be absent", key)
+	}
+	if !set.Add(key) {
+		t.Errorf("Expected Add to succeed")
+	}
+	if !set.Contains(key) {
+		t.Errorf("Expected %q to be present", key)
+	}
+	if !set.Remove(key) {
+		t.Errorf("Expected Remove to succeed")
+	}
+	if set.Contains(key) {
+		t.Errorf("Expected %q to be absent after Remove", key)
+	}
+	if set.Remove(key) {
+		t.Errorf("Expected Remove of an absent key to fail")
+	}
+}
+
+func TestEncodeDiff(t *testing.T) {
+	leader := NewFilter(1 << 16)
+	var hash [32]byte
+	for i := 0; i < 1000; i++ {
+		io.ReadFull(rand.Reader, hash[:])
+		leader.Insert(hash[:])
+	}
+	follower := CopyFilter(leader.Buckets, leader.Count, leader.BucketPow)
+	for i := 0; i < 10; i++ {
+		io.ReadFull(rand.Reader, hash[:])
+		leader.Insert(hash[:])
+	}
+
+	diff, err := leader.EncodeDiff(follower)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if full := len(leader.Encode()); len(diff) > full/100 {
+		t.Errorf("Expected diff to be much smaller than %d bytes, got %d", full, len(diff))
+	}
+	if err := follower.ApplyDiff(diff); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(leader, follower) {
+		t.Errorf("Expected follower to equal leader after ApplyDiff")
+	}
+
+	if _, err := leader.EncodeDiff(NewFilter(8)); err == nil {
+		t.Errorf("Expected err for mismatched sizes, got nil")
+	}
+	if err := NewFilter(8).ApplyDiff(diff); err == nil {
+		t.Errorf("Expected err for mismatched sizes, got nil")
+	}
+	if err := follower.ApplyDiff(diff[:len(diff)-1]); err == nil {
+		t.Errorf("Expected err for truncated diff, got nil")
+	}
+}
+
+func TestVictimPolicy(t *testing.T) {
+	for _, policy := range []VictimPolicy{VictimRoundRobin, VictimFirstSlot} {
+		cf1 := NewFilter(1<<10, WithVictimPolicy(policy))
+		cf2 := NewFilter(1<<10, WithVictimPolicy(policy))
+		var failures int
+		for i := 0; i < 2000; i++ {
+			data := []byte(strconv.Itoa(i))
+			ok1, fp1, index1 := cf1.InsertSpill(data)
+			ok2, fp2, index2 := cf2.InsertSpill(data)
+			if ok1 != ok2 || fp1 != fp2 || index1 != index2 {
+				t.Fatalf("Expected identical inserts for policy %d, got (%v, %d, %d) and (%v, %d, %d)",
+					policy, ok1, fp1, index1, ok2, fp2, index2)
+			}
+			if !ok1 {
+				failures++
+			}
+		}
+		if failures == 0 {
+			t.Errorf("Expected evictions to fail on an overfull filter for policy %d", policy)
+		}
+		if !reflect.DeepEqual(cf1.Encode(), cf2.Encode()) {
+			t.Errorf("Expected identical layouts for policy %d", policy)
+		}
+	}
+}
+
+func TestEvictionHistogram(t *testing.T) {
+	if h := NewFilter(1 << 10).EvictionHistogram(); h != nil {
+		t.Errorf("Expected nil histogram without the option, got %v", h)
+	}
+
+	cf := NewFilter(1<<10, WithEvictionHistogram())
+	var inserts, evicted int
+	var hash [32]byte
+	for cf.Count < 900 {
+		io.ReadFull(rand.Reader, hash[:])
+		cf.Insert(hash[:])
+		inserts++
+	}
+	for n, count := range cf.EvictionHistogram() {
+		inserts -= count
+		if n > 0 {
+			evicted += count
+		}
+	}
+	if inserts != 0 {
+		t.Errorf("Expected histogram to cover every insert, %d missing", inserts)
+	}
+	if evicted == 0 {
+		t.Errorf("Expected evictions on a near-full filter")
+	}
+}
+
+func TestMaxEvictionChain(t *testing.T) {
+	cf := NewFilter(1 << 10)
+	if n := cf.MaxEvictionChain(); n != 0 {
+		t.Errorf("Expected no eviction chain for an empty filter, got %d", n)
+	}
+	for i := 0; cf.Count < 1000; i++ {
+		cf.Insert([]byte("MaxEvictionChain_" + strconv.Itoa(i)))
+	}
+	if n := cf.MaxEvictionChain(); n <= 0 || n > cf.Params().MaxKicks {
+		t.Errorf("Expected an eviction chain on a near-full filter, got %d", n)
+	}
+	cf.Reset()
+	if n := cf.MaxEvictionChain(); n != 0 {
+		t.Errorf("Expected Reset to clear the eviction chain, got %d", n)
+	}
+}
+
+func TestFirstAbsent(t *testing.T) {
+	cf := NewFilter(1000)
+	var items [][]byte
+	for i := 0; i < 100; i++ {
+		data := []byte("FirstAbsent_" + strconv.Itoa(i))
+		cf.Insert(data)
+		items = append(items, data)
+	}
+	if i, found := cf.FirstAbsent(items); found || i != -1 {
+		t.Errorf("Expected all items present, got index %d", i)
+	}
+
+	cf.Delete(items[40])
+	cf.Delete(items[70])
+	if i, found := cf.FirstAbsent(items); !found || i != 40 {
+		t.Errorf("Expected first absent item at 40, got %d, %v", i, found)
+	}
+	if i, found := cf.FirstAbsent(nil); found || i != -1 {
+		t.Errorf("Expected no absent item in no items, got %d", i)
+	}
+}
+
+func TestNewEmptyLike(t *testing.T) {
+	cf := NewFilter(1000, WithMaxKicks(50), WithSalt(7))
+	cf.Tag = 3
+	for i := 0; i < 500; i++ {
+		cf.Insert([]byte("NewEmptyLike_" + strconv.Itoa(i)))
+	}
+	cf.Delete([]byte("NewEmptyLike_0"))
+
+	empty := cf.NewEmptyLike()
+	if empty.Capacity() != cf.Capacity() || empty.Params() != cf.Params() {
+		t.Errorf("Expected capacity %d and params %+v, got %d and %+v", cf.Capacity(), cf.Params(), empty.Capacity(), empty.Params())
+	}
+	if empty.Count != 0 || empty.OccupiedSlots() != 0 || empty.DeletionsCount() != 0 {
+		t.Errorf("Expected an empty filter, got %v", empty)
+	}
+	if empty.Tag != cf.Tag || empty.salt != cf.salt {
+		t.Errorf("Expected Tag and salt to carry over")
+	}
+	data := []byte("NewEmptyLike_1")
+	i1, i2 := empty.CandidateIndices(data)
+	if j1, j2 := cf.CandidateIndices(data); i1 != j1 || i2 != j2 {
+		t.Errorf("Expected keys to hash like in the source filter")
+	}
+}
+
+func TestInsertPressure(t *testing.T) {
+	cf := NewFilter(1000)
+	data := []byte("InsertPressure")
+	if p, a := cf.InsertPressure(data); p != bucketSize || a != bucketSize {
+		t.Errorf("Expected %d free slots in both buckets of an empty filter, got %d and %d", bucketSize, p, a)
+	}
+	cf.Insert(data)
+	if p, a := cf.InsertPressure(data); p+a != 2*bucketSize-1 {
+		t.Errorf("Expected one slot taken, got %d and %d free", p, a)
+	}
+	for i := 1; i < 2*bucketSize; i++ {
+		cf.Insert(data)
+	}
+	if p, a := cf.InsertPressure(data); p != 0 || a != 0 {
+		t.Errorf("Expected no free slots in full buckets, got %d and %d", p, a)
+	}
+}
+
+func TestLookupTiered(t *testing.T) {
+	hot, warm, cold := NewFilter(1000), NewFilter(1000), NewFilter(1000)
+	hot.Insert([]byte("hot"))
+	cold.Insert([]byte("cold"))
+
+	if !LookupTiered([]byte("cold"), hot, warm, cold) {
+		t.Errorf("Expected key in the last filter to be found")
+	}
+	if !LookupTiered([]byte("hot"), hot, warm, cold) {
+		t.Errorf("Expected key in the first filter to be found")
+	}
+	if LookupTiered([]byte("absent"), hot, warm, cold) {
+		t.Errorf("Expected absent key not to be found")
+	}
+	if LookupTiered([]byte("hot")) {
+		t.Errorf("Expected no filters to find nothing")
+	}
+}
+
+func TestAgreeOn(t *testing.T) {
+	small, large := NewFilter(1000), NewFilter(1<<16, WithSalt(42))
+	var keys [][]byte
+	for i := 0; i < 500; i++ {
+		data := []byte("AgreeOn_" + strconv.Itoa(i))
+		small.Insert(data)
+		large.Insert(data)
+		keys = append(keys, data)
+	}
+	if d := AgreeOn(small, large, keys); len(d) != 0 {
+		t.Errorf("Expected no disagreements on inserted keys, got %q", d)
+	}
+
+	large.Delete(keys[0])
+	if d := AgreeOn(small, large, keys); len(d) != 1 || !bytes.Equal(d[0], keys[0]) {
+		t.Errorf("Expected disagreement on %q only, got %q", keys[0], d)
+	}
+}
+
+func TestNewFilterFromBuckets(t *testing.T) {
+	if _, err := MakeFingerprint(0); err == nil {
+		t.Errorf("Expected err for fingerprint 0, got nil")
+	}
+
+	data := []byte("geeky ogre")
+	i1, fp := getIndexAndFingerprint(data, 2)
+	b, err := MakeFingerprint(byte(fp))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	layout := make([]byte, 4*bucketSize)
+	layout[int(i1)*bucketSize+3] = b
+	cf, err := NewFilterFromBuckets(layout, 1, 2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !cf.Lookup(data) {
+		t.Errorf("Expected %q to be found in its primary bucket", data)
+	}
+
+	layout[int(i1)*bucketSize+3] = 0
+	layout[int(getAltIndex(fp, i1, 2))*bucketSize] = b
+	cf, _ = NewFilterFromBuckets(layout, 1, 2)
+	if !cf.Lookup(data) {
+		t.Errorf("Expected %q to be found in its alternate bucket", data)
+	}
+
+	if _, err := NewFilterFromBuckets(layout, 1, 3); err == nil {
+		t.Errorf("Expected err for mismatched layout size, got nil")
+	}
+	for _, pow := range []uint{maxBucketPow + 1, 62, 64} {
+		if _, err := NewFilterFromBuckets(nil, 0, pow); err == nil {
+			t.Errorf("Expected err for bucketPow %d, got nil", pow)
+		}
+	}
+}
+
+func TestLookupLocation(t *testing.T) {
+	cf := NewFilter(1000)
+	data := []byte("geeky ogre")
+	if found, index, slot := cf.LookupLocation(data); found || index != 0 || slot != -1 {
+		t.Errorf("Expected (false, 0, -1), got (%v, %d, %d)", found, index, slot)
+	}
+
+	cf.Insert(data)
+	found, index, slot := cf.LookupLocation(data)
+	if !found {
+		t.Fatalf("Expected %q to be found", data)
+	}
+	_, fp := getIndexAndFingerprint(data, cf.BucketPow)
+	if cf.Buckets[index][slot] != fp {
+		t.Errorf("Expected fingerprint %d at bucket %d slot %d, got %d", fp, index, slot, cf.Buckets[index][slot])
+	}
+}
+
+func TestDeleteBatch(t *testing.T) {
+	cf := NewFilter(1000)
+	var items [][]byte
+	for i := 0; i < 10; i++ {
+		item := []byte("DeleteBatch_" + strconv.Itoa(i))
+		if i%2 == 0 {
+			cf.Insert(item)
+		}
+		items = append(items, item)
+	}
+
+	if deleted := cf.DeleteBatch(items); deleted != 5 {
+		t.Errorf("Expected 5 deleted, got %d", deleted)
+	}
+	if count := cf.CountEntries(); count != 0 {
+		t.Errorf("Expected count = 0, instead count == %d", count)
+	}
+	if deleted := cf.DeleteBatch(items); deleted != 0 {
+		t.Errorf("Expected 0 deleted, got %d", deleted)
+	}
+}
+
+func TestSymmetricDiffCount(t *testing.T) {
+	a, b := NewFilter(1<<14), NewFilter(1<<14)
+	for i := 0; i < 2000; i++ {
+		data := []byte("SymmetricDiffCount_" + strconv.Itoa(i))
+		a.Insert(data)
+		b.Insert(data)
+	}
+	if diff, err := a.SymmetricDiffCount(b); err != nil || diff != 0 {
+		t.Errorf("Expected (0, nil), got (%d, %v)", diff, err)
+	}
+
+	for i := 0; i < 50; i++ {
+		a.Insert([]byte("SymmetricDiffCount_a_" + strconv.Itoa(i)))
+		b.Insert([]byte("SymmetricDiffCount_b_" + strconv.Itoa(i)))
+	}
+	diff, err := a.SymmetricDiffCount(b)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if diff < 95 || diff > 100 {
+		t.Errorf("Expected a difference close to 100, got %d", diff)
+	}
+
+	if _, err := a.SymmetricDiffCount(NewFilter(8)); err == nil {
+		t.Errorf("Expected err for mismatched sizes, got nil")
+	}
+}
+
+func TestLookupStream(t *testing.T) {
+	cf := NewFilter(1000)
+	cf.Insert([]byte("a"))
+	cf.Insert([]byte("c"))
+
+	in := make(chan []byte)
+	out := cf.LookupStream(in)
+	go func() {
+		for _, key := range []string{"a", "b", "c", "d"} {
+			in <- []byte(key)
+		}
+		close(in)
+	}()
+
+	var results []bool
+	for found := range out {
+		results = append(results, found)
+	}
+	if expected := []bool{true, false, true, false}; !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+}
+
+func TestDeleteAbsent(t *testing.T) {
+	cf := NewFilter(1000)
+	if cf.Delete([]byte("absent")) {
+		t.Errorf("Expected delete of an absent key to fail")
+	}
+	if count := cf.CountEntries(); count != 0 {
+		t.Errorf("Expected count = 0, instead count == %d", count)
+	}
+
+	cf.Insert([]byte("once"))
+	cf.Insert([]byte("twice"))
+	cf.Insert([]byte("twice"))
+	if !cf.Delete([]byte("once")) {
+		t.Errorf("Expected first delete to succeed")
+	}
+	if cf.Delete([]byte("once")) {
+		t.Errorf("Expected double delete to fail")
+	}
+	for i := 0; i < 2; i++ {
+		if !cf.Delete([]byte("twice")) {
+			t.Errorf("Expected delete %d of a twice inserted key to succeed", i+1)
+		}
+	}
+	if cf.Delete([]byte("twice")) {
+		t.Errorf("Expected third delete of a twice inserted key to fail")
+	}
+	if count := cf.CountEntries(); count != 0 {
+		t.Errorf("Expected count = 0, instead count == %d", count)
+	}
+
+	// a corrupted Count must not underflow
+	cf.Insert([]byte("once"))
+	cf.Count = 0
+	cf.Delete([]byte("once"))
+	if count := cf.CountEntries(); count != 0 {
+		t.Errorf("Expected count = 0, instead count == %d", count)
+	}
+}
+
+func TestWiden(t *testing.T) {
+	cf := NewFilter(1000)
+	cf.Insert([]byte("geeky ogre"))
+	if err := cf.Widen(); err == nil {
+		t.Errorf("Expected err, got nil")
+	}
+	if !cf.Lookup([]byte("geeky ogre")) {
+		t.Errorf("Expected Widen to leave the filter untouched")
+	}
 }
 
 func BenchmarkFilter_Reset(b *testing.B) {
@@ -109,3 +717,865 @@ func BenchmarkFilter_Lookup(b *testing.B) {
 		filter.Lookup(hash[:])
 	}
 }
+
+func TestCollapseDuplicates(t *testing.T) {
+	data := []byte("CollapseDuplicates")
+	cf := NewFilter(1000, WithCollapseDuplicates())
+	for i := 0; i < 100; i++ {
+		if !cf.Insert(data) {
+			t.Fatalf("Expected repeated insert %d to succeed", i)
+		}
+	}
+	if cf.OccupiedSlots() != 1 || cf.CountEntries() != 1 {
+		t.Errorf("Expected repeated inserts to take 1 slot, got %d slots and count %d", cf.OccupiedSlots(), cf.CountEntries())
+	}
+	if !cf.Delete(data) || cf.Lookup(data) {
+		t.Errorf("Expected a single delete to remove the collapsed key")
+	}
+
+	plain := NewFilter(1000)
+	for i := 0; i < 100; i++ {
+		plain.Insert(data)
+	}
+	if plain.OccupiedSlots() != 2*bucketSize {
+		t.Errorf("Expected repeated inserts without the option to fill both buckets, got %d slots", plain.OccupiedSlots())
+	}
+}
+
+func TestCollapseDuplicatesBatch(t *testing.T) {
+	var items [][]byte
+	for r := 0; r < 5; r++ {
+		for i := 0; i < 500; i++ {
+			items = append(items, []byte("CollapseDuplicatesBatch_"+strconv.Itoa(i)))
+		}
+	}
+	sequential := NewFilter(1<<12, WithCollapseDuplicates())
+	var records [][]byte
+	for _, data := range items {
+		sequential.Insert(data)
+		records = append(records, sequential.EncodeInsertRecord(data))
+	}
+	want := sequential.OccupiedSlots()
+	if want > 500 {
+		t.Fatalf("Expected at most 500 slots, got %d", want)
+	}
+
+	batch := NewFilter(1<<12, WithCollapseDuplicates())
+	if inserted, failed := batch.InsertBatchCollect(items); inserted != len(items) || len(failed) != 0 {
+		t.Errorf("Expected all %d items inserted, got %d", len(items), inserted)
+	}
+	parallel, err := NewFilterParallel(1<<12, items, 4, WithCollapseDuplicates())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	replayed := NewFilter(1<<12, WithCollapseDuplicates())
+	for _, record := range records {
+		if err := replayed.ApplyInsertRecord(record); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	striped := NewStripedFilter(1<<12, 4, WithCollapseDuplicates())
+	for _, data := range items {
+		striped.Insert(data)
+	}
+	for name, got := range map[string]uint{
+		"InsertBatchCollect": batch.OccupiedSlots(),
+		"NewFilterParallel":  parallel.OccupiedSlots(),
+		"ApplyInsertRecord":  replayed.OccupiedSlots(),
+		"StripedFilter":      striped.CountEntries(),
+	} {
+		if got != want {
+			t.Errorf("Expected %s to take %d slots like Insert, got %d", name, want, got)
+		}
+	}
+
+	double := NewDoubleFingerprintFilter(1<<12, WithCollapseDuplicates())
+	for _, data := range items {
+		double.Insert(data)
+	}
+	if count := double.CountEntries(); count > 500 {
+		t.Errorf("Expected DoubleFingerprintFilter to hold at most 500 items, got %d", count)
+	}
+}
+
+func TestInsertAssumeNew(t *testing.T) {
+	plain, assumed := NewFilterWithSource(1000, mrand.NewSource(1)), NewFilterWithSource(1000, mrand.NewSource(1))
+	for i := 0; i < 900; i++ {
+		data := []byte("InsertAssumeNew_" + strconv.Itoa(i))
+		if ok, expected := assumed.InsertAssumeNew(data), plain.Insert(data); ok != expected {
+			t.Errorf("Expected InsertAssumeNew(%q) = %v like Insert, got %v", data, expected, ok)
+		}
+	}
+	if !bytes.Equal(plain.Encode(), assumed.Encode()) {
+		t.Errorf("Expected InsertAssumeNew to build the same filter as Insert")
+	}
+
+	data := []byte("InsertAssumeNew_0")
+	count := assumed.CountEntries()
+	assumed.InsertAssumeNew(data)
+	if assumed.CountEntries() != count+1 {
+		t.Errorf("Expected InsertAssumeNew to store a present key again")
+	}
+}
+
+// benchmarkInsertNovel inserts distinct keys, emptying the filter whenever
+// it reaches its nominal load
+func benchmarkInsertNovel(b *testing.B, insert func(*Filter, []byte) bool) {
+	const cap = 1 << 14
+	filter := NewFilter(cap)
+	keys := make([][]byte, cap*9/10)
+	for i := range keys {
+		keys[i] = []byte("novel_" + strconv.Itoa(i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(keys) == 0 {
+			filter.Reset()
+		}
+		insert(filter, keys[i%len(keys)])
+	}
+}
+
+func BenchmarkFilter_InsertUniqueNovel(b *testing.B) {
+	benchmarkInsertNovel(b, (*Filter).InsertUnique)
+}
+
+func BenchmarkFilter_InsertAssumeNew(b *testing.B) {
+	benchmarkInsertNovel(b, (*Filter).InsertAssumeNew)
+}
+
+func TestLookupReusedBufferDoesNotAllocate(t *testing.T) {
+	filter := NewFilter(10000)
+	buf := make([]byte, 0, 32)
+	for i := 0; i < 5000; i++ {
+		buf = strconv.AppendInt(buf[:0], int64(i), 10)
+		filter.Insert(buf)
+	}
+
+	i := 0
+	allocs := testing.AllocsPerRun(1000, func() {
+		buf = strconv.AppendInt(buf[:0], int64(i), 10)
+		filter.Lookup(buf)
+		i++
+	})
+	if allocs != 0 {
+		t.Errorf("Expected Lookup of a reused buffer not to allocate, got %v allocs", allocs)
+	}
+}
+
+func BenchmarkFilter_LookupReusedBuffer(b *testing.B) {
+	const cap = 10000
+	filter := NewFilter(cap)
+	buf := make([]byte, 0, 32)
+	for i := 0; i < cap/2; i++ {
+		buf = strconv.AppendInt(buf[:0], int64(i), 10)
+		filter.Insert(buf)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = strconv.AppendInt(buf[:0], int64(i%cap), 10)
+		filter.Lookup(buf)
+	}
+}
+
+func TestDeleteKeepsCountConsistent(t *testing.T) {
+	rng := mrand.New(mrand.NewSource(1))
+	cf := NewFilterWithSource(512, mrand.NewSource(2))
+	key := func() []byte {
+		return []byte("DeleteCount_" + strconv.Itoa(rng.Intn(600)))
+	}
+	for step := 0; step < 20000; step++ {
+		switch rng.Intn(4) {
+		case 0:
+			cf.Insert(key())
+			continue
+		case 1:
+			cf.Delete(key())
+		case 2:
+			cf.DeleteAt(byte(rng.Intn(256)), uint(rng.Intn(len(cf.Buckets))))
+		case 3:
+			cf.delete(fingerprint(rng.Intn(256)), uint(rng.Intn(len(cf.Buckets))))
+		}
+		if cf.Count != cf.OccupiedSlots() || cf.Count != countOccupied(cf.Buckets) {
+			t.Fatalf("Step %d: expected Count %d to equal occupied slots %d", step, cf.Count, countOccupied(cf.Buckets))
+		}
+	}
+}
+
+func TestMeasureFPR(t *testing.T) {
+	cf := NewFilter(1 << 14)
+	for i := 0; i < 15000; i++ {
+		cf.Insert([]byte("MeasureFPR_" + strconv.Itoa(i)))
+	}
+	negative := make([][]byte, 200000)
+	for i := range negative {
+		negative[i] = []byte("absent_" + strconv.Itoa(i))
+	}
+
+	expected, measured := cf.FalsePositiveRate(), cf.MeasureFPR(negative)
+	if math.Abs(measured-expected) > expected/10 {
+		t.Errorf("Expected measured false positive rate %.5f to be within 10%% of %.5f", measured, expected)
+	}
+	if cf.MeasureFPR(nil) != 0 || NewFilter(1000).FalsePositiveRate() != 0 {
+		t.Errorf("Expected no false positives without keys or items")
+	}
+}
+
+// BenchmarkFilter_InsertEvictionHeavy fills a filter to 95% load over
+// and over, so most inserts evict and many exhaust their kick budget
+func BenchmarkFilter_InsertEvictionHeavy(b *testing.B) {
+	const pow = 10
+	filter := NewFilterPow(pow, WithMaxKicks(100))
+	keys := make([][]byte, (bucketSize<<pow)*95/100)
+	for i := range keys {
+		keys[i] = []byte("eviction_" + strconv.Itoa(i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%len(keys) == 0 {
+			filter.Reset()
+		}
+		filter.Insert(keys[i%len(keys)])
+	}
+}
+
+func TestLookupWithConfidence(t *testing.T) {
+	cf := NewFilter(1 << 12)
+	data := []byte("LookupWithConfidence")
+	cf.Insert(data)
+	last := 1.0
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 1200; j++ {
+			cf.Insert([]byte("LookupWithConfidence_" + strconv.Itoa(i) + "_" + strconv.Itoa(j)))
+		}
+		found, confidence := cf.LookupWithConfidence(data)
+		if !found || confidence >= last || confidence <= 0 {
+			t.Errorf("Expected confidence below %v after filling, got %v, %v", last, found, confidence)
+		}
+		last = confidence
+
+		if found, confidence := cf.LookupWithConfidence([]byte("absent")); found || confidence != 1 {
+			t.Errorf("Expected full confidence for an absent key, got %v, %v", found, confidence)
+		}
+	}
+}
+
+func TestDeletionsPerformed(t *testing.T) {
+	cf := NewFilter(1000)
+	for i := 0; i < 100; i++ {
+		cf.Insert([]byte("DeletionsPerformed_" + strconv.Itoa(i)))
+	}
+	cf.Delete([]byte("absent"))
+	if cf.DeletionsPerformed() {
+		t.Errorf("Expected no deletions for an insert-only filter")
+	}
+	cf.Delete([]byte("DeletionsPerformed_0"))
+	if !cf.DeletionsPerformed() {
+		t.Errorf("Expected deletions after Delete")
+	}
+	if !cf.FalseNegativesPossible() {
+		t.Errorf("Expected false negatives to be possible after Delete")
+	}
+	cf.Reset()
+	if cf.DeletionsPerformed() || cf.FalseNegativesPossible() {
+		t.Errorf("Expected no deletions after Reset")
+	}
+}
+
+func TestFalseNegativesPossibleAfterFailedInsert(t *testing.T) {
+	cf := NewFilterPow(4)
+	var inserted [][]byte
+	for i := 0; i < 1000; i++ {
+		data := []byte("FalseNegatives_" + strconv.Itoa(i))
+		if cf.Insert(data) {
+			inserted = append(inserted, data)
+		}
+	}
+	if cf.DeletionsPerformed() {
+		t.Errorf("Expected no deletions for an insert-only filter")
+	}
+	if !cf.FalseNegativesPossible() {
+		t.Errorf("Expected false negatives to be possible after failed inserts")
+	}
+	var missing int
+	for _, data := range inserted {
+		if !cf.Lookup(data) {
+			missing++
+		}
+	}
+	if missing == 0 {
+		t.Errorf("Expected failed inserts to drop inserted items")
+	}
+
+	bounded := NewFilterPow(4, WithMaxKicks(16))
+	for i := 0; i < 1000; i++ {
+		bounded.Insert([]byte("FalseNegatives_" + strconv.Itoa(i)))
+	}
+	if bounded.FalseNegativesPossible() {
+		t.Errorf("Expected bounded inserts to never drop a fingerprint")
+	}
+}
+
+func TestMaxKicks(t *testing.T) {
+	const budget = 16
+	cf := NewFilter(1<<10, WithMaxKicks(budget), WithEvictionHistogram())
+	if kicks := cf.Params().MaxKicks; kicks != budget {
+		t.Errorf("Expected MaxKicks = %d, got %d", budget, kicks)
+	}
+
+	var inserted [][]byte
+	var failed int
+	for i := 0; i < 1000; i++ {
+		item := []byte("MaxKicks_" + strconv.Itoa(i))
+		before := cf.Encode()
+		if ok, fp, index := cf.InsertSpill(item); ok {
+			inserted = append(inserted, item)
+		} else {
+			failed++
+			i1, want := getIndexAndFingerprint(item, cf.BucketPow)
+			if fingerprint(fp) != want || index != i1 {
+				t.Errorf("Expected spill of %s itself, got fingerprint %d at %d", item, fp, index)
+			}
+			if !bytes.Equal(before, cf.Encode()) {
+				t.Errorf("Expected failed insert of %s to leave the filter unchanged", item)
+			}
+		}
+	}
+	if len(inserted) < 900 {
+		t.Errorf("Expected most inserts to succeed, got %d of 1000", len(inserted))
+	}
+	if failed == 0 {
+		t.Errorf("Expected some inserts to exceed the budget")
+	}
+	for n := range cf.EvictionHistogram() {
+		if n > budget {
+			t.Errorf("Expected at most %d evictions per insert, got %d", budget, n)
+		}
+	}
+	for _, item := range inserted {
+		if !cf.Lookup(item) {
+			t.Errorf("Expected %s to be present", item)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	cf := NewFilterPow(10)
+	for i := 0; i < 512; i++ {
+		cf.Insert([]byte("String_" + strconv.Itoa(i)))
+	}
+	if s, want := cf.String(), "Filter{buckets=1024 pow=10 count=512 load=0.125}"; s != want {
+		t.Errorf("Expected %q, got %q", want, s)
+	}
+}
+
+func TestDeleteAt(t *testing.T) {
+	cf := NewFilter(1000)
+	data := []byte("DeleteAt")
+	cf.Insert(data)
+	cf.Insert([]byte("other"))
+	i1, fp := getIndexAndFingerprint(data, cf.BucketPow)
+
+	if cf.DeleteAt(0, i1) {
+		t.Errorf("Expected DeleteAt of the empty fingerprint to fail")
+	}
+	if cf.DeleteAt(byte(fp), uint(len(cf.Buckets))) {
+		t.Errorf("Expected DeleteAt out of range to fail")
+	}
+	if !cf.DeleteAt(byte(fp), getAltIndex(fp, i1, cf.BucketPow)) {
+		t.Errorf("Expected DeleteAt via the alternate bucket to succeed")
+	}
+	if cf.Lookup(data) {
+		t.Errorf("Expected %s to be deleted", data)
+	}
+	if count := cf.CountEntries(); count != 1 {
+		t.Errorf("Expected count = 1, instead count == %d", count)
+	}
+	if cf.DeleteAt(byte(fp), i1) {
+		t.Errorf("Expected second DeleteAt to fail")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := NewFilter(1<<12), NewFilter(1<<12)
+	for i := 0; i < 1000; i++ {
+		a.Insert([]byte("Merge_" + strconv.Itoa(i)))
+		b.Insert([]byte("Merge_" + strconv.Itoa(i+500)))
+	}
+
+	naive := NewFilter(1 << 12)
+	for _, cf := range []*Filter{a, b} {
+		if err := naive.Merge(cf); err != nil {
+			t.Fatalf("Expected merge to succeed, got %v", err)
+		}
+	}
+	if count := naive.CountEntries(); count != 2000 {
+		t.Errorf("Expected count = 2000, instead count == %d", count)
+	}
+
+	if err := a.MergeUnique(b); err != nil {
+		t.Fatalf("Expected merge to succeed, got %v", err)
+	}
+	if count := a.CountEntries(); count >= 2000 || count < 1490 {
+		t.Errorf("Expected count close to 1500, instead count == %d", count)
+	}
+	for i := 0; i < 1500; i++ {
+		if data := []byte("Merge_" + strconv.Itoa(i)); !a.Lookup(data) {
+			t.Errorf("Expected %s to be present after merge", data)
+		}
+	}
+
+	if err := a.Merge(NewFilter(1 << 14)); err == nil {
+		t.Errorf("Expected merge of a different bucketPow to fail")
+	}
+}
+
+func TestMergeFullKeepsMembers(t *testing.T) {
+	target, source := NewFilterPow(6), NewFilterPow(6)
+	for i := 0; i < 180; i++ {
+		if data := []byte("MergeFull_" + strconv.Itoa(i)); !target.Insert(data) {
+			t.Fatalf("Expected %s to be inserted", data)
+		}
+		source.Insert([]byte("MergeFull_other_" + strconv.Itoa(i)))
+	}
+	if err := target.Merge(source); err == nil {
+		t.Fatalf("Expected merge into a full filter to fail")
+	}
+	for i := 0; i < 180; i++ {
+		if data := []byte("MergeFull_" + strconv.Itoa(i)); !target.Lookup(data) {
+			t.Errorf("Expected %s to be present after a failed merge", data)
+		}
+	}
+	if target.FalseNegativesPossible() {
+		t.Errorf("Expected a failed merge to drop no fingerprint")
+	}
+}
+
+func TestCountMatches(t *testing.T) {
+	cf := NewFilter(1000)
+	once, twice := []byte("once"), []byte("twice")
+	cf.Insert(once)
+	cf.Insert(twice)
+	cf.Insert(twice)
+	if n := cf.CountMatches(once); n != 1 {
+		t.Errorf("Expected 1 match, got %d", n)
+	}
+	if n := cf.CountMatches(twice); n != 2 {
+		t.Errorf("Expected 2 matches, got %d", n)
+	}
+	if n := cf.CountMatches([]byte("absent")); n != 0 {
+		t.Errorf("Expected 0 matches, got %d", n)
+	}
+
+	// With a single bucket both candidates are the same bucket.
+	single := NewFilterPow(0)
+	single.Insert(once)
+	if n := single.CountMatches(once); n != 1 {
+		t.Errorf("Expected 1 match in a single bucket filter, got %d", n)
+	}
+}
+
+func TestOccupiedSlots(t *testing.T) {
+	cf := NewFilterPow(6)
+	rng := mrand.New(mrand.NewSource(1))
+	var stored [][]byte
+	for n := 0; n < 20000; n++ {
+		if len(stored) > 0 && rng.Intn(3) == 0 {
+			k := rng.Intn(len(stored))
+			cf.Delete(stored[k])
+			stored = append(stored[:k], stored[k+1:]...)
+		} else {
+			data := []byte("OccupiedSlots_" + strconv.Itoa(n))
+			if cf.Insert(data) {
+				stored = append(stored, data)
+			}
+		}
+		if got, want := cf.OccupiedSlots(), countOccupied(cf.Buckets); got != want {
+			t.Fatalf("Expected %d occupied slots after %d operations, got %d", want, n, got)
+		}
+	}
+	if load := cf.LoadFactor(); load < 0.5 {
+		t.Errorf("Expected a loaded filter with evictions, got load %v", load)
+	}
+
+	cf.Reset()
+	if occupied := cf.OccupiedSlots(); occupied != 0 {
+		t.Errorf("Expected 0 occupied slots after Reset, got %d", occupied)
+	}
+}
+
+func TestSalt(t *testing.T) {
+	a, b := NewFilter(1<<16, WithSalt(1)), NewFilter(1<<16, WithSalt(1))
+	c, unsalted := NewFilter(1<<16, WithSalt(2)), NewFilter(1<<16)
+	var differ int
+	for i := 0; i < 100; i++ {
+		data := []byte("Salt_" + strconv.Itoa(i))
+		ia, fpa := a.getIndexAndFingerprint(data)
+		ib, fpb := b.getIndexAndFingerprint(data)
+		if ia != ib || fpa != fpb {
+			t.Errorf("Expected equal salts to hash %s alike", data)
+		}
+		ic, fpc := c.getIndexAndFingerprint(data)
+		iu, fpu := unsalted.getIndexAndFingerprint(data)
+		if ia != ic && fpa != fpc && ia != iu && fpa != fpu {
+			differ++
+		}
+	}
+	if differ < 95 {
+		t.Errorf("Expected different salts to hash keys differently, only %d of 100 did", differ)
+	}
+
+	for i := 0; i < 1000; i++ {
+		a.Insert([]byte("Salt_" + strconv.Itoa(i)))
+	}
+	for i := 0; i < 1000; i++ {
+		if data := []byte("Salt_" + strconv.Itoa(i)); !a.Lookup(data) {
+			t.Errorf("Expected %s to be found in a salted filter", data)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	cf := NewFilter(1<<14, WithSalt(3))
+	cf.Tag = 7
+	for i := 0; i < 15000; i++ {
+		cf.Insert([]byte("Compact_" + strconv.Itoa(i)))
+	}
+	for i := 1000; i < 15000; i++ {
+		cf.Delete([]byte("Compact_" + strconv.Itoa(i)))
+	}
+
+	compacted, reclaimed := cf.Compact()
+	if len(compacted.Buckets) >= len(cf.Buckets) {
+		t.Errorf("Expected fewer than %d buckets, got %d", len(cf.Buckets), len(compacted.Buckets))
+	}
+	if expected := (len(cf.Buckets) - len(compacted.Buckets)) * bucketSize; reclaimed <= 0 || reclaimed != expected {
+		t.Errorf("Expected %d bytes reclaimed, got %d", expected, reclaimed)
+	}
+	if cf.MemoryUsage() != uint64(len(cf.Buckets))*bucketSize {
+		t.Errorf("Expected MemoryUsage %d, got %d", len(cf.Buckets)*bucketSize, cf.MemoryUsage())
+	}
+	if load := compacted.LoadFactor(); load > 0.9 {
+		t.Errorf("Expected load at most 0.9, got %v", load)
+	}
+	if compacted.CountEntries() != cf.CountEntries() || compacted.Tag != cf.Tag {
+		t.Errorf("Expected count %d and tag %d, got %d and %d", cf.CountEntries(), cf.Tag, compacted.CountEntries(), compacted.Tag)
+	}
+	for i := 0; i < 1000; i++ {
+		if data := []byte("Compact_" + strconv.Itoa(i)); !compacted.Lookup(data) {
+			t.Errorf("Expected %s to be found after Compact", data)
+		}
+	}
+	if !compacted.DeletionsPerformed() || !compacted.FalseNegativesPossible() {
+		t.Errorf("Expected Compact to keep the deletions of its source")
+	}
+
+	full := NewFilterPow(4)
+	for i := 0; full.LoadFactor() < 0.95; i++ {
+		full.Insert([]byte("Compact_" + strconv.Itoa(i)))
+	}
+	if compacted, reclaimed := full.Compact(); compacted.BucketPow != full.BucketPow || reclaimed != 0 || !bytes.Equal(compacted.EncodeCanonical(), full.EncodeCanonical()) {
+		t.Errorf("Expected a full filter to compact to a copy of itself, reclaiming nothing")
+	}
+	for i := 0; full.Insert([]byte("Compact_overflow_" + strconv.Itoa(i))); i++ {
+	}
+	if compacted, _ := full.Compact(); !compacted.FalseNegativesPossible() || compacted.DeletionsPerformed() {
+		t.Errorf("Expected Compact to keep the dropped fingerprints of its source")
+	}
+}
+
+func TestFindCollisions(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 2000; i++ {
+		keys = append(keys, []byte("FindCollisions_"+strconv.Itoa(i)))
+	}
+	const pow = 4
+	groups := FindCollisions(keys, pow)
+	if len(groups) == 0 {
+		t.Fatalf("Expected collisions among %d keys in %d buckets", len(keys), 1<<pow)
+	}
+	for _, group := range groups {
+		if len(group) < 2 {
+			t.Errorf("Expected groups of at least 2 keys, got %d", len(group))
+		}
+		cf := NewFilterPow(pow)
+		cf.Insert(group[0])
+		for _, key := range group[1:] {
+			if !cf.Lookup(key) {
+				t.Errorf("Expected %s to collide with %s", key, group[0])
+			}
+		}
+	}
+
+	if groups := FindCollisions(keys[:2], 20); len(groups) != 0 {
+		t.Errorf("Expected no collisions, got %q", groups)
+	}
+}
+
+func TestClone(t *testing.T) {
+	cf := NewFilter(1000, WithSalt(5), WithEvictionHistogram())
+	cf.Insert([]byte("Clone"))
+	clone := cf.Clone()
+	if !reflect.DeepEqual(cf, clone) {
+		t.Errorf("Expected %v, got %v", cf, clone)
+	}
+	clone.Insert([]byte("only in clone"))
+	if cf.Lookup([]byte("only in clone")) || cf.EvictionHistogram()[0] != 1 {
+		t.Errorf("Expected the clone not to share state with the original")
+	}
+	if !clone.Lookup([]byte("Clone")) {
+		t.Errorf("Expected the clone to hold the original's items")
+	}
+}
+
+func TestEstimateBatchEvictions(t *testing.T) {
+	cf := NewFilter(1<<12, WithVictimPolicy(VictimRoundRobin), WithEvictionHistogram())
+	var items [][]byte
+	for i := 0; i < 3900; i++ {
+		items = append(items, []byte("EstimateBatchEvictions_"+strconv.Itoa(i)))
+	}
+	cf.InsertBatch(items[:3000])
+	before := cf.Encode()
+
+	estimate := cf.EstimateBatchEvictions(items[3000:])
+	if !bytes.Equal(before, cf.Encode()) {
+		t.Errorf("Expected the estimate to leave the filter unchanged")
+	}
+	if estimate == 0 {
+		t.Errorf("Expected evictions on a near-full filter")
+	}
+
+	histogram := cf.EvictionHistogram()
+	if inserted := cf.InsertBatch(items[3000:]); inserted == 0 {
+		t.Errorf("Expected inserts to succeed")
+	}
+	var actual int
+	for n, count := range cf.EvictionHistogram() {
+		actual += n * (count - histogram[n])
+	}
+	if estimate != actual {
+		t.Errorf("Expected estimate %d to equal actual evictions %d", estimate, actual)
+	}
+}
+
+func TestLookupCount(t *testing.T) {
+	cf := NewFilter(1000)
+	present, absent := []byte("present"), []byte("absent")
+	cf.Insert(present)
+	if n := cf.LookupCount([][]byte{present, absent, present, absent, present}); n != 3 {
+		t.Errorf("Expected 3 hits, got %d", n)
+	}
+	if n := cf.LookupCount(nil); n != 0 {
+		t.Errorf("Expected 0 hits, got %d", n)
+	}
+}
+
+func TestNewFilterReport(t *testing.T) {
+	for _, tc := range []struct{ capacity, want uint }{
+		{0, 8},
+		{1000, 1024},
+		{1024, 1024},
+		{1025, 2048},
+	} {
+		cf, actual := NewFilterReport(tc.capacity)
+		if actual != tc.want || actual != cf.Capacity() {
+			t.Errorf("Expected capacity %d for %d, got %d and Capacity() %d", tc.want, tc.capacity, actual, cf.Capacity())
+		}
+	}
+}
+
+func TestInsertBatchCollect(t *testing.T) {
+	cf := NewFilterPow(4)
+	var items [][]byte
+	for i := 0; i < 100; i++ {
+		items = append(items, []byte("InsertBatchCollect_"+strconv.Itoa(i)))
+	}
+	inserted, failed := cf.InsertBatchCollect(items)
+	if inserted+len(failed) != len(items) || inserted > int(cf.Capacity()) {
+		t.Fatalf("Expected %d inserted and failed items with at most %d inserted, got %d and %d", len(items), cf.Capacity(), inserted, len(failed))
+	}
+	if count := cf.CountEntries(); count != uint(inserted) {
+		t.Errorf("Expected count = %d, instead count == %d", inserted, count)
+	}
+
+	isFailed := make(map[string]bool)
+	for _, data := range failed {
+		isFailed[string(data)] = true
+	}
+	for _, data := range items {
+		if !isFailed[string(data)] && !cf.Lookup(data) {
+			t.Errorf("Expected inserted item %s to be present", data)
+		}
+	}
+	retry := NewFilter(1000)
+	if inserted, failed := retry.InsertBatchCollect(failed); len(failed) != 0 {
+		t.Errorf("Expected failed items to fit a larger filter, %d inserted, %d failed", inserted, len(failed))
+	}
+}
+
+func TestMembership(t *testing.T) {
+	member, absent := []byte("member"), []byte("absent")
+	filter := NewFilter(1000)
+	filter.Insert(member)
+	scalable := NewScalableCuckooFilter()
+	scalable.Insert(member)
+	decaying := NewDecayingFilter(1000)
+	decaying.Insert(member)
+	striped := NewStripedFilter(1000, 4)
+	striped.Insert(member)
+	safe := NewSafeFilter(1000)
+	safe.Insert(member)
+	cached := NewCachedFilter(NewFilter(1000), 16)
+	cached.Insert(member)
+	adaptive := NewAdaptiveFilter(1000)
+	adaptive.Insert(member)
+
+	for name, m := range map[string]Membership{
+		"Filter":               filter,
+		"ScalableCuckooFilter": scalable,
+		"DecayingFilter":       decaying,
+		"ImmutableFilter":      filter.Freeze(),
+		"StripedFilter":        striped,
+		"SafeFilter":           safe,
+		"CachedFilter":         cached,
+		"AdaptiveFilter":       adaptive,
+	} {
+		if !m.Lookup(member) || m.Lookup(absent) {
+			t.Errorf("%s: expected only %q to be found", name, member)
+		}
+		if count := m.CountEntries(); count != 1 {
+			t.Errorf("%s: expected count = 1, instead count == %d", name, count)
+		}
+	}
+}
+
+func TestCountInvariant(t *testing.T) {
+	cf := NewFilterPow(5, WithSalt(1))
+	rng := mrand.New(mrand.NewSource(2))
+	key := func() []byte {
+		return []byte("CountInvariant_" + strconv.Itoa(rng.Intn(300)))
+	}
+	for n := 0; n < 50000; n++ {
+		switch rng.Intn(5) {
+		case 0, 1:
+			cf.Insert(key())
+		case 2:
+			cf.InsertUnique(key())
+		case 3:
+			cf.Delete(key())
+		default:
+			i1, fp := getIndexAndFingerprint(key(), cf.BucketPow)
+			cf.DeleteAt(byte(fp), i1)
+		}
+		if cf.Count > cf.Capacity() || cf.Count != cf.OccupiedSlots() {
+			t.Fatalf("Expected count in [0, %d] equal to %d occupied slots after %d operations, got %d", cf.Capacity(), cf.OccupiedSlots(), n, cf.Count)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	churned := NewFilterPow(10, WithVictimPolicy(VictimFirstSlot))
+	for i := 0; i < 3800; i++ {
+		churned.Insert([]byte("Rebalance_" + strconv.Itoa(i)))
+	}
+	for i := 0; i < 3800; i += 2 {
+		churned.Delete([]byte("Rebalance_" + strconv.Itoa(i)))
+	}
+	rebalanced := churned.Clone()
+	if moved := rebalanced.Rebalance(); moved == 0 {
+		t.Fatalf("Expected Rebalance to move fingerprints")
+	}
+	if rebalanced.Count != churned.Count || rebalanced.OccupiedSlots() != churned.OccupiedSlots() {
+		t.Errorf("Expected Rebalance to keep count %d, got %d", churned.Count, rebalanced.Count)
+	}
+	for i := 0; i < 5000; i++ {
+		if data := []byte("Rebalance_" + strconv.Itoa(i)); rebalanced.Lookup(data) != churned.Lookup(data) {
+			t.Errorf("Expected Rebalance to keep membership of %s", data)
+		}
+	}
+
+	// Count the inserts that find a free slot without evicting.
+	direct := func(cf *Filter) int {
+		var n int
+		for i := 0; i < 1500; i++ {
+			i1, fp := getIndexAndFingerprint([]byte("Rebalance_new_"+strconv.Itoa(i)), cf.BucketPow)
+			if _, ok := cf.insertDirect(fp, i1); ok {
+				n++
+			}
+		}
+		return n
+	}
+	before, after := direct(churned), direct(rebalanced)
+	t.Logf("inserts without evictions: %d before Rebalance, %d after", before, after)
+	if after <= before {
+		t.Errorf("Expected more inserts without evictions after Rebalance, got %d before and %d after", before, after)
+	}
+}
+
+func TestIncompatibleParams(t *testing.T) {
+	a := NewFilter(1 << 12)
+	for _, tc := range []struct {
+		other *Filter
+		field string
+	}{
+		{NewFilter(1 << 14), "BucketPow"},
+		{NewFilter(1<<12, WithSalt(1)), "salt"},
+	} {
+		errs := []error{a.Merge(tc.other), a.MergeUnique(tc.other)}
+		_, err := a.SymmetricDiffCount(tc.other)
+		errs = append(errs, err)
+		_, err = JaccardEstimate(a, tc.other)
+		errs = append(errs, err)
+		for _, err := range errs {
+			if !errors.Is(err, ErrIncompatibleParams) || !strings.Contains(err.Error(), tc.field) {
+				t.Errorf("Expected ErrIncompatibleParams naming %s, got %v", tc.field, err)
+			}
+		}
+	}
+
+	// fingerprint width and bucket size are fixed for Filter, so only the
+	// check itself can see them differ
+	params := a.Params()
+	for field, other := range map[string]FilterParams{
+		"FingerprintBits": {BucketSize: params.BucketSize, FingerprintBits: 16, BucketPow: params.BucketPow},
+		"BucketSize":      {BucketSize: 8, FingerprintBits: params.FingerprintBits, BucketPow: params.BucketPow},
+		"BucketPow":       {BucketSize: params.BucketSize, FingerprintBits: params.FingerprintBits, BucketPow: params.BucketPow + 1},
+	} {
+		err := params.compatibleWith(other)
+		if !errors.Is(err, ErrIncompatibleParams) || !strings.Contains(err.Error(), field) {
+			t.Errorf("Expected ErrIncompatibleParams naming %s, got %v", field, err)
+		}
+	}
+	if err := params.compatibleWith(NewFilter(1<<12, WithMaxKicks(10)).Params()); err != nil {
+		t.Errorf("Expected MaxKicks not to matter, got %v", err)
+	}
+}
+
+func TestJaccardEstimate(t *testing.T) {
+	a, b := NewFilter(1<<14), NewFilter(1<<14)
+	for i := 0; i < 3000; i++ {
+		a.Insert([]byte("JaccardEstimate_" + strconv.Itoa(i)))
+		b.Insert([]byte("JaccardEstimate_" + strconv.Itoa(i+1500)))
+	}
+	// 1500 shared items out of 4500 distinct ones
+	if j, err := JaccardEstimate(a, b); err != nil || math.Abs(j-1.0/3) > 0.02 {
+		t.Errorf("Expected (0.333, nil), got (%v, %v)", j, err)
+	}
+	if j, err := JaccardEstimate(a, a); err != nil || j != 1 {
+		t.Errorf("Expected (1, nil), got (%v, %v)", j, err)
+	}
+	if j, err := JaccardEstimate(a, NewFilter(1<<14)); err != nil || j != 0 {
+		t.Errorf("Expected (0, nil), got (%v, %v)", j, err)
+	}
+	if _, err := JaccardEstimate(a, NewFilter(1<<12)); err == nil {
+		t.Errorf("Expected err for different bucketPow, got nil")
+	}
+	if _, err := JaccardEstimate(a, NewFilter(1<<14, WithSalt(1))); err == nil {
+		t.Errorf("Expected err for different salts, got nil")
+	}
+}
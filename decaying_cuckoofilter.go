@@ -0,0 +1,55 @@
+package cuckoo
+
+// DecayingFilter approximates a sliding time window with two generations of
+// Filter. Inserts go to the active generation, lookups check both, and
+// Rotate drops the older one, so an item expires after two rotations.
+type DecayingFilter struct {
+	generations [2]*Filter
+	active      int
+}
+
+// NewDecayingFilter returns a DecayingFilter whose generations each have
+// the given capacity
+func NewDecayingFilter(capacity uint, opts ...FilterOption) *DecayingFilter {
+	return &DecayingFilter{
+		generations: [2]*Filter{
+			NewFilter(capacity, opts...),
+			NewFilter(capacity, opts...),
+		},
+	}
+}
+
+func (df *DecayingFilter) Lookup(data []byte) bool {
+	return df.generations[df.active].Lookup(data) || df.generations[1-df.active].Lookup(data)
+}
+
+func (df *DecayingFilter) Insert(data []byte) bool {
+	return df.generations[df.active].Insert(data)
+}
+
+func (df *DecayingFilter) InsertUnique(data []byte) bool {
+	if df.Lookup(data) {
+		return false
+	}
+	return df.Insert(data)
+}
+
+func (df *DecayingFilter) Delete(data []byte) bool {
+	return df.generations[df.active].Delete(data) || df.generations[1-df.active].Delete(data)
+}
+
+func (df *DecayingFilter) CountEntries() uint {
+	return df.generations[0].Count + df.generations[1].Count
+}
+
+// Rotate clears the older generation and makes it the active one
+func (df *DecayingFilter) Rotate() {
+	df.active = 1 - df.active
+	df.generations[df.active].Reset()
+}
+
+func (df *DecayingFilter) Reset() {
+	for _, filter := range df.generations {
+		filter.Reset()
+	}
+}
@@ -0,0 +1,27 @@
+package cuckoo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecayingFilter(t *testing.T) {
+	filter := NewDecayingFilter(1000)
+	old := []byte("old")
+	recent := []byte("recent")
+
+	assert.True(t, filter.Insert(old))
+	filter.Rotate()
+	assert.True(t, filter.Lookup(old))
+
+	assert.True(t, filter.Insert(recent))
+	filter.Rotate()
+	assert.False(t, filter.Lookup(old))
+	assert.True(t, filter.Lookup(recent))
+	assert.EqualValues(t, 1, filter.CountEntries())
+
+	filter.Rotate()
+	assert.False(t, filter.Lookup(recent))
+	assert.EqualValues(t, 0, filter.CountEntries())
+}
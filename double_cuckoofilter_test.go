@@ -0,0 +1,75 @@
+package cuckoo
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoubleFingerprintFilter(t *testing.T) {
+	filter := NewDoubleFingerprintFilter(1000)
+	data := []byte("DoubleFingerprintFilter")
+	assert.False(t, filter.Lookup(data))
+	assert.True(t, filter.Insert(data))
+	assert.True(t, filter.Lookup(data))
+	assert.EqualValues(t, 1, filter.CountEntries())
+	assert.True(t, filter.Delete(data))
+	assert.False(t, filter.Lookup(data))
+	assert.False(t, filter.Delete(data))
+	assert.EqualValues(t, 0, filter.CountEntries())
+}
+
+func TestDoubleFingerprintFilterFalsePositives(t *testing.T) {
+	// Both filters take the same memory and hold the same items.
+	const slots = 1 << 14
+	single, double := NewFilter(slots), NewDoubleFingerprintFilter(slots)
+	items := slots * 2 / 5
+	for i := 0; i < items; i++ {
+		data := []byte("DoubleFingerprintFilter_" + strconv.Itoa(i))
+		assert.True(t, single.Insert(data))
+		assert.True(t, double.Insert(data))
+	}
+	assert.EqualValues(t, items, double.CountEntries())
+	for i := 0; i < items; i++ {
+		assert.True(t, double.Lookup([]byte("DoubleFingerprintFilter_"+strconv.Itoa(i))))
+	}
+
+	const queries = 200000
+	var singleFP, doubleFP int
+	for i := 0; i < queries; i++ {
+		data := []byte("absent_" + strconv.Itoa(i))
+		if single.Lookup(data) {
+			singleFP++
+		}
+		if double.Lookup(data) {
+			doubleFP++
+		}
+	}
+	t.Logf("false positive rate: single %.5f, double %.5f", float64(singleFP)/queries, float64(doubleFP)/queries)
+	assert.Less(t, doubleFP*10, singleFP)
+}
+
+func TestDoubleFingerprintFilterLookupBothHalves(t *testing.T) {
+	filter := NewDoubleFingerprintFilter(1000)
+	first, second := []byte("first half only"), []byte("second half only")
+	i1, fp1 := filter.fingerprint(first, 0)
+	assert.True(t, filter.filter.insertFingerprintOrUndo(fp1, i1))
+	i2, fp2 := filter.fingerprint(second, doubleSalt)
+	assert.True(t, filter.filter.insertFingerprintOrUndo(fp2, i2))
+	assert.False(t, filter.Lookup(first))
+	assert.False(t, filter.Lookup(second))
+
+	both := []byte("both halves")
+	assert.True(t, filter.Insert(both))
+	assert.True(t, filter.Lookup(both))
+}
+
+func TestDoubleFingerprintFilterKeyTransform(t *testing.T) {
+	filter := NewDoubleFingerprintFilter(1000, WithKeyTransform(bytes.ToLower))
+	assert.True(t, filter.Insert([]byte("MiXeD")))
+	assert.True(t, filter.Lookup([]byte("mixed")))
+	assert.True(t, filter.Delete([]byte("MIXED")))
+	assert.False(t, filter.Lookup([]byte("mixed")))
+}
@@ -0,0 +1,754 @@
+package cuckoo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Encoded filters start with a header:
+//
+//	magic     4 bytes, "CKOO"
+//	version   1 byte
+//	bucketPow 1 byte
+//	count     8 bytes, little-endian
+//	tag       4 bytes, little-endian
+//	deletions 8 bytes, little-endian, only in version 3 and 4 headers,
+//	          written for filters created with WithDeletionsInHeader
+//	salt      8 bytes, little-endian, only in version 4 headers, written
+//	          for filters created with WithSalt
+//
+// followed by the fingerprints of every bucket and a CRC-32 (IEEE) checksum
+// of everything before it, 4 bytes little-endian.
+//
+// Encodings written before the header was added hold only the fingerprints
+// of every bucket, with no magic or checksum. They are still decoded when
+// their length is a power of two number of buckets and they do not start
+// with a magic, except when every byte is zero: an empty legacy filter can
+// not be told apart from zeroed memory and is rejected as corrupt.
+//
+// Multi-byte fields are always written little-endian through
+// encoding/binary, whatever the host's byte order, so encoded filters move
+// between architectures unchanged. Fingerprints are single bytes and need
+// no byte order; wider fingerprints must be written little-endian too.
+const (
+	encodingVersion     = 2
+	deletionsVersion    = 3
+	saltVersion         = 4
+	headerSize          = 18
+	deletionsHeaderSize = headerSize + 8
+	saltHeaderSize      = deletionsHeaderSize + 8
+	checksumSize        = 4
+)
+
+var (
+	encodingMagic = [4]byte{'C', 'K', 'O', 'O'}
+	sparseMagic   = [4]byte{'C', 'K', 'O', 'S'}
+)
+
+// Errors returned, possibly wrapped, when decoding a filter
+var (
+	ErrEmptyInput = errors.New("bytes can not be empty")
+	ErrBadLength  = errors.New("bad length")
+	ErrBadHeader  = errors.New("bad header")
+
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+type header struct {
+	// size is the length of the encoded header, 0 for legacy encodings
+	size      int
+	bucketPow uint
+	count     uint
+	tag       uint32
+	deletions uint
+	// hasDeletions is set for version 3 and 4 headers
+	hasDeletions bool
+	salt         uint64
+}
+
+// headerLen returns the length of the counter's encoded header
+func (cf *Filter) headerLen() int {
+	if cf.salt != 0 {
+		return saltHeaderSize
+	}
+	if cf.deletionsInHeader {
+		return deletionsHeaderSize
+	}
+	return headerSize
+}
+
+func (cf *Filter) encodeHeader(bytes []byte) {
+	cf.encodeHeaderMagic(bytes, encodingMagic)
+}
+
+func (cf *Filter) encodeHeaderMagic(bytes []byte, magic [4]byte) {
+	copy(bytes, magic[:])
+	bytes[4] = encodingVersion
+	bytes[5] = byte(cf.BucketPow)
+	binary.LittleEndian.PutUint64(bytes[6:], uint64(cf.Count))
+	binary.LittleEndian.PutUint32(bytes[14:], cf.Tag)
+	if cf.salt != 0 {
+		bytes[4] = saltVersion
+		binary.LittleEndian.PutUint64(bytes[18:], uint64(cf.Deletions))
+		binary.LittleEndian.PutUint64(bytes[26:], cf.salt)
+	} else if cf.deletionsInHeader {
+		bytes[4] = deletionsVersion
+		binary.LittleEndian.PutUint64(bytes[18:], uint64(cf.Deletions))
+	}
+}
+
+func decodeHeader(bytes []byte) (header, error) {
+	if h, ok := legacyHeader(bytes); ok {
+		return h, nil
+	}
+	return decodeHeaderMagic(bytes, encodingMagic)
+}
+
+// legacyHeader returns the header implied by an encoding written before
+// headers were added, and false unless bytes has that shape
+func legacyHeader(bytes []byte) (header, bool) {
+	n := len(bytes) / bucketSize
+	if n == 0 || len(bytes)%bucketSize != 0 || n&(n-1) != 0 || isSparse(bytes) ||
+		[4]byte{bytes[0], bytes[1], bytes[2], bytes[3]} == encodingMagic {
+		return header{}, false
+	}
+	pow := uint(bits.TrailingZeros(uint(n)))
+	if pow > maxBucketPow {
+		return header{}, false
+	}
+	var count uint
+	for _, fp := range bytes {
+		if fp != nullFp {
+			count++
+		}
+	}
+	if count == 0 {
+		return header{}, false
+	}
+	return header{bucketPow: pow, count: count}, true
+}
+
+// decodeAnyHeader decodes the header of an encoding returned by Encode or
+// EncodeSparse
+func decodeAnyHeader(bytes []byte) (header, error) {
+	if isSparse(bytes) {
+		return decodeHeaderMagic(bytes, sparseMagic)
+	}
+	return decodeHeader(bytes)
+}
+
+// isSparse returns whether bytes starts with the magic of EncodeSparse
+func isSparse(bytes []byte) bool {
+	return len(bytes) >= len(sparseMagic) && [4]byte{bytes[0], bytes[1], bytes[2], bytes[3]} == sparseMagic
+}
+
+func decodeHeaderMagic(bytes []byte, magic [4]byte) (header, error) {
+	if len(bytes) == 0 {
+		return header{}, ErrEmptyInput
+	}
+	if len(bytes) < headerSize {
+		return header{}, fmt.Errorf("%w: expected at least %d bytes, got %d", ErrBadLength, headerSize, len(bytes))
+	}
+	if [4]byte{bytes[0], bytes[1], bytes[2], bytes[3]} != magic {
+		return header{}, fmt.Errorf("%w: bad magic %x, data is corrupt or not a filter", ErrBadHeader, bytes[:4])
+	}
+	size := headerSize
+	switch bytes[4] {
+	case encodingVersion:
+	case deletionsVersion:
+		size = deletionsHeaderSize
+	case saltVersion:
+		size = saltHeaderSize
+	default:
+		return header{}, fmt.Errorf("%w: unsupported encoding version %d", ErrBadHeader, bytes[4])
+	}
+	if len(bytes) < size {
+		return header{}, fmt.Errorf("%w: expected at least %d bytes, got %d", ErrBadLength, size, len(bytes))
+	}
+	h := header{
+		size:      size,
+		bucketPow: uint(bytes[5]),
+		count:     uint(binary.LittleEndian.Uint64(bytes[6:])),
+		tag:       binary.LittleEndian.Uint32(bytes[14:]),
+	}
+	if h.bucketPow > maxBucketPow {
+		return header{}, fmt.Errorf("%w: bucketPow %d exceeds maximum %d", ErrBadHeader, h.bucketPow, maxBucketPow)
+	}
+	if count, slots := binary.LittleEndian.Uint64(bytes[6:]), uint64(bucketSize)<<h.bucketPow; count > slots {
+		return header{}, fmt.Errorf("%w: count %d exceeds capacity %d", ErrBadHeader, count, slots)
+	}
+	if size >= deletionsHeaderSize {
+		h.deletions = uint(binary.LittleEndian.Uint64(bytes[18:]))
+		h.hasDeletions = true
+	}
+	if size == saltHeaderSize {
+		h.salt = binary.LittleEndian.Uint64(bytes[26:])
+		if h.salt == 0 {
+			return header{}, fmt.Errorf("%w: version %d header without a salt", ErrBadHeader, saltVersion)
+		}
+	}
+	return h, nil
+}
+
+// putChecksum writes the checksum of the rest of bytes to its last
+// checksumSize bytes
+func putChecksum(bytes []byte) {
+	n := len(bytes) - checksumSize
+	binary.LittleEndian.PutUint32(bytes[n:], crc32.ChecksumIEEE(bytes[:n]))
+}
+
+func verifyChecksum(bytes []byte) error {
+	n := len(bytes) - checksumSize
+	want := binary.LittleEndian.Uint32(bytes[n:])
+	if got := crc32.ChecksumIEEE(bytes[:n]); got != want {
+		return fmt.Errorf("%w: expected %08x, got %08x, data is corrupt", ErrChecksumMismatch, want, got)
+	}
+	return nil
+}
+
+// EncodeSparse returns a byte slice representing a Cuckoofilter that only
+// holds its occupied slots, which is much smaller than Encode for lightly
+// loaded filters. It has the same header and checksum as Encode, with magic
+// "CKOS", followed by the number of occupied slots and, for each in order,
+// the distance in slots from the previous one and its fingerprint. Decode
+// and DecodeSparse read it.
+func (cf *Filter) EncodeSparse() []byte {
+	bytes := make([]byte, cf.headerLen(), uint(cf.headerLen())+binary.MaxVarintLen64+2*cf.OccupiedSlots()+checksumSize)
+	cf.encodeHeaderMagic(bytes, sparseMagic)
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], uint64(countOccupied(cf.Buckets)))
+	bytes = append(bytes, varint[:n]...)
+	var last uint64
+	for i, b := range cf.Buckets {
+		for j, fp := range b {
+			if fp == nullFp {
+				continue
+			}
+			pos := uint64(i*bucketSize + j)
+			n := binary.PutUvarint(varint[:], pos-last)
+			bytes = append(bytes, varint[:n]...)
+			bytes = append(bytes, byte(fp))
+			last = pos
+		}
+	}
+	bytes = append(bytes, make([]byte, checksumSize)...)
+	putChecksum(bytes)
+	return bytes
+}
+
+// EncodeSmallest returns the shorter of Encode and EncodeSparse. Decode
+// reads either.
+func (cf *Filter) EncodeSmallest() []byte {
+	// A sparse slot takes at least 2 bytes against 1 per slot for Encode.
+	if 2*cf.OccupiedSlots() >= uint(len(cf.Buckets))*bucketSize {
+		return cf.Encode()
+	}
+	if sparse := cf.EncodeSparse(); len(sparse) < cf.headerLen()+len(cf.Buckets)*bucketSize+checksumSize {
+		return sparse
+	}
+	return cf.Encode()
+}
+
+// DecodeSparse returns a Cuckoofilter from a byte slice returned by
+// EncodeSparse
+func DecodeSparse(bytes []byte) (*Filter, error) {
+	return decodeSparse(bytes, nil)
+}
+
+// decodeSparse returns a Cuckoofilter from a sparse encoding, reusing
+// buckets if it has enough capacity
+func decodeSparse(bytes []byte, buckets []bucket) (*Filter, error) {
+	h, payload, err := sparsePayload(bytes)
+	if err != nil {
+		return nil, err
+	}
+	// validate every slot before allocating, as a short encoding may claim
+	// a large bucketPow
+	n, err := walkSparse(payload, h.bucketPow, nil)
+	if err != nil {
+		return nil, err
+	}
+	cf := &Filter{Buckets: reuseBuckets(buckets, h.bucketPow), BucketPow: h.bucketPow}
+	walkSparse(payload, h.bucketPow, func(pos uint64, fp fingerprint) {
+		cf.Buckets[pos/bucketSize][pos%bucketSize] = fp
+	})
+	cf.Count = h.count
+	cf.Tag = h.tag
+	cf.Deletions = h.deletions
+	cf.deleted = h.deletions > 0
+	cf.deletionsInHeader = h.hasDeletions
+	cf.salt = h.salt
+	cf.setOccupied(uint(n))
+	return cf, nil
+}
+
+// sparsePayload checks the header, length and checksum of a sparse
+// encoding and returns its header and the slots between them
+func sparsePayload(bytes []byte) (header, []byte, error) {
+	h, err := decodeHeaderMagic(bytes, sparseMagic)
+	if err != nil {
+		return header{}, nil, err
+	}
+	if len(bytes) < h.size+checksumSize+1 {
+		return header{}, nil, fmt.Errorf("%w: expected at least %d bytes, got %d", ErrBadLength, h.size+checksumSize+1, len(bytes))
+	}
+	if err := verifyChecksum(bytes); err != nil {
+		return header{}, nil, err
+	}
+	return h, bytes[h.size : len(bytes)-checksumSize], nil
+}
+
+// walkSparse validates the slots of a sparse encoding, calling set, if not
+// nil, with the position and fingerprint of each, and returns their number
+func walkSparse(payload []byte, bucketPow uint, set func(pos uint64, fp fingerprint)) (uint64, error) {
+	n, k := binary.Uvarint(payload)
+	slots := uint64(bucketSize) << bucketPow
+	if k <= 0 || n > slots {
+		return 0, fmt.Errorf("%w: invalid number of occupied slots", ErrBadLength)
+	}
+	payload = payload[k:]
+	var pos uint64
+	for s := uint64(0); s < n; s++ {
+		delta, k := binary.Uvarint(payload)
+		if k <= 0 || len(payload) < k+1 {
+			return 0, fmt.Errorf("%w: truncated slot %d of %d", ErrBadLength, s, n)
+		}
+		if pos += delta; (s > 0 && delta == 0) || pos >= slots || payload[k] == nullFp {
+			return 0, fmt.Errorf("invalid slot %d at position %d", s, pos)
+		}
+		if set != nil {
+			set(pos, fingerprint(payload[k]))
+		}
+		payload = payload[k+1:]
+	}
+	if len(payload) != 0 {
+		return 0, fmt.Errorf("%w: %d trailing bytes", ErrBadLength, len(payload))
+	}
+	return n, nil
+}
+
+// IsValidEncoding reports whether Decode would accept bytes, checking the
+// header, length, checksum and, for sparse encodings, every slot, without
+// allocating buckets
+func IsValidEncoding(bytes []byte) bool {
+	if isSparse(bytes) {
+		h, payload, err := sparsePayload(bytes)
+		if err != nil {
+			return false
+		}
+		_, err = walkSparse(payload, h.bucketPow, nil)
+		return err == nil
+	}
+	_, _, err := densePayload(bytes)
+	return err == nil
+}
+
+// ExportStandard returns the fingerprints in the memory layout of the
+// reference C++ implementation with 8-bit tags: buckets stored one after the
+// other, each holding its fingerprints in slot order as single bytes, 0
+// marking an empty slot. Unlike Encode there is no header; the receiver must
+// know bucketPow and the bucket size, and must hash keys the same way as
+// this package for lookups to agree.
+func (cf *Filter) ExportStandard() ([]byte, error) {
+	if n := uint64(1) << cf.BucketPow; uint64(len(cf.Buckets)) != n {
+		return nil, fmt.Errorf("expected %d buckets for bucketPow %d, got %d", n, cf.BucketPow, len(cf.Buckets))
+	}
+	data := make([]byte, len(cf.Buckets)*bucketSize)
+	for i, b := range cf.Buckets {
+		for j, fp := range b {
+			data[i*bucketSize+j] = byte(fp)
+		}
+	}
+	return data, nil
+}
+
+// ImportStandard returns a Cuckoofilter from fingerprints in the layout
+// produced by ExportStandard. Only a bucketSize of 4 is supported. The count
+// is the number of occupied slots.
+func ImportStandard(data []byte, bucketPow uint, bucketSize int) (*Filter, error) {
+	if bucketSize != len(bucket{}) {
+		return nil, fmt.Errorf("unsupported bucket size %d, expected %d", bucketSize, len(bucket{}))
+	}
+	if bucketPow > maxBucketPow {
+		return nil, fmt.Errorf("bucketPow %d exceeds maximum %d", bucketPow, maxBucketPow)
+	}
+	cf, err := NewFilterFromBuckets(data, 0, bucketPow)
+	if err != nil {
+		return nil, err
+	}
+	cf.Count = cf.OccupiedSlots()
+	cf.skew = 0
+	return cf, nil
+}
+
+// textHeader starts the output of DumpText
+const textHeader = "cuckoo bucketPow=%d count=%d tag=%d\n"
+
+// DumpText writes the counter as text for debugging: a header line with
+// BucketPow, Count and Tag, then one "bucketIndex slot fingerprintHex" line
+// per occupied slot in bucket order, so dumps of similar filters diff
+// cleanly. LoadText reads it back. Salted filters can not be dumped, as the
+// text has no room for the salt.
+func (cf *Filter) DumpText(w io.Writer) error {
+	if cf.salt != 0 {
+		return fmt.Errorf("can not dump a salted filter as text, use Encode")
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, textHeader, cf.BucketPow, cf.Count, cf.Tag)
+	for i, b := range cf.Buckets {
+		for j, fp := range b {
+			if fp != nullFp {
+				fmt.Fprintf(bw, "%d %d %02x\n", i, j, byte(fp))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadText returns a Cuckoofilter from text written by DumpText
+func LoadText(r io.Reader) (*Filter, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrEmptyInput
+	}
+	var pow, count uint
+	var tag uint32
+	if _, err := fmt.Sscanf(scanner.Text()+"\n", textHeader, &pow, &count, &tag); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadHeader, err)
+	}
+	if pow > maxBucketPow {
+		return nil, fmt.Errorf("%w: bucketPow %d exceeds maximum %d", ErrBadHeader, pow, maxBucketPow)
+	}
+	cf := NewFilterPow(pow)
+	if slots := uint(len(cf.Buckets)) * bucketSize; count > slots {
+		return nil, fmt.Errorf("%w: count %d exceeds capacity %d", ErrBadHeader, count, slots)
+	}
+	cf.Count = count
+	cf.Tag = tag
+	var occupied uint
+	for line := 2; scanner.Scan(); line++ {
+		var i uint
+		var j int
+		var fp byte
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d %x", &i, &j, &fp); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if i >= uint(len(cf.Buckets)) || j < 0 || j >= bucketSize || fp == nullFp {
+			return nil, fmt.Errorf("line %d: invalid slot %q", line, scanner.Text())
+		}
+		if cf.Buckets[i][j] != nullFp {
+			return nil, fmt.Errorf("line %d: slot %d of bucket %d given twice", line, j, i)
+		}
+		cf.Buckets[i][j] = fingerprint(fp)
+		occupied++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if count < occupied {
+		return nil, fmt.Errorf("%w: count %d is below the %d slots given", ErrBadHeader, count, occupied)
+	}
+	cf.setOccupied(occupied)
+	return cf, nil
+}
+
+// BuildFromReader returns a new Filter with a given capacity holding every
+// newline-delimited key read from r, along with the number of keys
+// inserted. Lines may be of any length; a trailing "\r" is dropped and
+// empty lines are skipped. It fails if an insert fails or r returns an
+// error, returning the filter built so far.
+func BuildFromReader(capacity uint, r io.Reader) (*Filter, int, error) {
+	cf := NewFilter(capacity)
+	br := bufio.NewReader(r)
+	n := 0
+	for line := 1; ; line++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return cf, n, err
+		}
+		key := bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r"))
+		if len(key) > 0 {
+			if !cf.Insert(key) {
+				return cf, n, fmt.Errorf("failed to insert line %d, filter is full", line)
+			}
+			n++
+		}
+		if err == io.EOF {
+			return cf, n, nil
+		}
+	}
+}
+
+// Records returned by EncodeInsertRecord and EncodeDeleteRecord
+const (
+	recordInsert byte = 1
+	recordDelete byte = 2
+)
+
+// EncodeInsertRecord returns a small record of inserting data: its primary
+// bucket index and fingerprint. Appending a record per insert to a log and
+// replaying the log with ApplyInsertRecord on an empty filter with the same
+// BucketPow rebuilds the counter without re-encoding it.
+func (cf *Filter) EncodeInsertRecord(data []byte) []byte {
+	return cf.encodeRecord(recordInsert, data)
+}
+
+// EncodeDeleteRecord returns a record of deleting data like
+// EncodeInsertRecord, to be replayed with ApplyDeleteRecord
+func (cf *Filter) EncodeDeleteRecord(data []byte) []byte {
+	return cf.encodeRecord(recordDelete, data)
+}
+
+func (cf *Filter) encodeRecord(kind byte, data []byte) []byte {
+	i, fp := cf.getIndexAndFingerprint(data)
+	record := make([]byte, 2+binary.MaxVarintLen64)
+	record[0] = kind
+	record[1] = byte(fp)
+	n := binary.PutUvarint(record[2:], uint64(i))
+	return record[:2+n]
+}
+
+// decodeRecord returns the kind, fingerprint and bucket index of a record
+func decodeRecord(record []byte) (byte, fingerprint, uint64, error) {
+	if len(record) < 3 || (record[0] != recordInsert && record[0] != recordDelete) || record[1] == nullFp {
+		return 0, 0, 0, fmt.Errorf("invalid record %x", record)
+	}
+	i, n := binary.Uvarint(record[2:])
+	if n != len(record)-2 {
+		return 0, 0, 0, fmt.Errorf("invalid record %x", record)
+	}
+	return record[0], fingerprint(record[1]), i, nil
+}
+
+// ApplyInsertRecord inserts the fingerprint described by a record returned
+// by EncodeInsertRecord
+func (cf *Filter) ApplyInsertRecord(record []byte) error {
+	kind, fp, i, err := decodeRecord(record)
+	if err != nil || kind != recordInsert {
+		return fmt.Errorf("invalid insert record %x", record)
+	}
+	if i >= uint64(len(cf.Buckets)) {
+		return fmt.Errorf("bucket index %d out of range", i)
+	}
+	if cf.collapses(fp, uint(i)) {
+		return nil
+	}
+	if ok, _, _ := cf.insertFingerprint(fp, uint(i)); !ok {
+		return fmt.Errorf("failed to insert record, filter is full")
+	}
+	return nil
+}
+
+// ApplyDeleteRecord deletes the fingerprint described by a record returned
+// by EncodeDeleteRecord. Like Delete it does nothing if the fingerprint is
+// not stored.
+func (cf *Filter) ApplyDeleteRecord(record []byte) error {
+	kind, fp, i, err := decodeRecord(record)
+	if err != nil || kind != recordDelete {
+		return fmt.Errorf("invalid delete record %x", record)
+	}
+	if i >= uint64(len(cf.Buckets)) {
+		return fmt.Errorf("bucket index %d out of range", i)
+	}
+	if !cf.delete(fp, uint(i)) {
+		cf.delete(fp, getAltIndex(fp, uint(i), cf.BucketPow))
+	}
+	return nil
+}
+
+// CompactLog folds a log of insert and delete records for a filter with
+// 2^bucketPow buckets into the insert records left after deletes cancel
+// inserts. Replaying the result on an empty filter stores the same
+// fingerprints as replaying the whole log, though evictions may place them
+// in different slots. Deletes are matched like Delete matches them: a
+// fingerprint in either candidate bucket, which may have been inserted
+// for a different key, and deletes of absent fingerprints are dropped.
+func CompactLog(records [][]byte, bucketPow uint) ([][]byte, error) {
+	if bucketPow > maxBucketPow {
+		return nil, fmt.Errorf("bucketPow %d exceeds maximum %d", bucketPow, maxBucketPow)
+	}
+	type pair struct {
+		fp fingerprint
+		i  uint
+	}
+	type entry struct {
+		count  int
+		record []byte
+	}
+	entries := make(map[pair]*entry)
+	var order []pair
+	for _, record := range records {
+		kind, fp, i, err := decodeRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		if i > uint64(masks[bucketPow]) {
+			return nil, fmt.Errorf("bucket index %d out of range", i)
+		}
+		// a fingerprint's candidate buckets identify it, whichever of them
+		// the record names
+		p := pair{fp, uint(i)}
+		if alt := getAltIndex(fp, uint(i), bucketPow); alt < p.i {
+			p.i = alt
+		}
+		e := entries[p]
+		switch {
+		case kind == recordInsert && e == nil:
+			entries[p] = &entry{count: 1, record: record}
+			order = append(order, p)
+		case kind == recordInsert:
+			e.count++
+			e.record = record
+		case e != nil && e.count > 0:
+			e.count--
+		}
+	}
+	var compacted [][]byte
+	for _, p := range order {
+		e := entries[p]
+		for k := 0; k < e.count; k++ {
+			compacted = append(compacted, e.record)
+		}
+	}
+	return compacted, nil
+}
+
+// DecodePooled returns a Cuckoofilter from a byte slice like Decode, dense
+// or sparse, taking the bucket array from pool when one with enough
+// capacity is available. Hand the buckets back with Release once the filter
+// is no longer used. A pooled array that is too small is put back for
+// smaller filters.
+func DecodePooled(bytes []byte, pool *sync.Pool) (*Filter, error) {
+	var buckets []bucket
+	if p, ok := pool.Get().(*[]bucket); ok {
+		buckets = *p
+	}
+	var cf *Filter
+	var err error
+	if isSparse(bytes) {
+		cf, err = decodeSparse(bytes, buckets)
+	} else {
+		cf, err = decode(bytes, buckets)
+	}
+	if adopted := err == nil && cap(buckets) >= len(cf.Buckets); buckets != nil && !adopted {
+		pool.Put(&buckets)
+	}
+	return cf, err
+}
+
+// Release puts the counter's bucket array into pool for reuse by
+// DecodePooled and empties the counter, which must not be used afterwards.
+func (cf *Filter) Release(pool *sync.Pool) {
+	buckets := cf.Buckets
+	cf.Buckets = nil
+	cf.Count = 0
+	cf.skew = 0
+	pool.Put(&buckets)
+}
+
+// WriteTo writes the encoded counter to w
+func (cf *Filter) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(cf.Encode())
+	return int64(n), err
+}
+
+// ReadFrom replaces the contents of the counter with an encoded counter
+// read from r until EOF
+func (cf *Filter) ReadFrom(r io.Reader) (int64, error) {
+	bytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return int64(len(bytes)), err
+	}
+	return int64(len(bytes)), cf.SwapFrom(bytes)
+}
+
+// SwapFrom replaces the contents of the counter with an encoded counter,
+// keeping its options except the salt, which is taken from the encoding
+// since the fingerprints were placed with it. The bytes are fully decoded
+// before anything is replaced, so on error the counter is unchanged. The
+// fields are still assigned one by one: use SafeFilter.SwapFrom to swap
+// under concurrent lookups.
+func (cf *Filter) SwapFrom(bytes []byte) error {
+	filter, err := Decode(bytes)
+	if err != nil {
+		return err
+	}
+	cf.swap(filter)
+	return nil
+}
+
+// swap replaces the contents of the counter with those of filter
+func (cf *Filter) swap(filter *Filter) {
+	cf.Buckets = filter.Buckets
+	cf.Count = filter.Count
+	cf.skew = filter.skew
+	cf.BucketPow = filter.BucketPow
+	cf.Tag = filter.Tag
+	cf.salt = filter.salt
+	cf.deleted = filter.deleted
+	cf.lost = filter.lost
+	if filter.deletionsInHeader {
+		cf.Deletions = filter.Deletions
+		cf.deletionsInHeader = true
+	}
+}
+
+// SaveToFile writes the encoded counter to path. The data is written to a
+// temporary file in the same directory, synced and then renamed over path,
+// so a crash never leaves a partially written file at path.
+func (cf *Filter) SaveToFile(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := cf.WriteTo(w)
+		return err
+	})
+}
+
+// LoadFromFile returns a Cuckoofilter read from a file written by SaveToFile
+func LoadFromFile(path string) (*Filter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cf := &Filter{}
+	if _, err := cf.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+func writeFileAtomic(path string, write func(io.Writer) error) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if err = write(f); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,647 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cuckoo")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filter")
+
+	filter := NewFilter(10000)
+	for i := 0; i < 1000; i++ {
+		filter.Insert([]byte("SaveToFile_" + strconv.Itoa(i)))
+	}
+	assert.Nil(t, filter.SaveToFile(path))
+
+	loaded, err := LoadFromFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, filter, loaded)
+
+	// a failed write must leave the previous file untouched
+	err = writeFileAtomic(path, func(w io.Writer) error {
+		w.Write([]byte{1, 2, 3})
+		return errors.New("interrupted")
+	})
+	assert.EqualError(t, err, "interrupted")
+	loaded, err = LoadFromFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, filter, loaded)
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestEncodeTag(t *testing.T) {
+	filter := NewFilter(1000)
+	filter.Tag = 42
+	filter.Insert([]byte("tagged"))
+	bytes := filter.Encode()
+
+	decoded, err := Decode(bytes)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 42, decoded.Tag)
+	assert.Equal(t, filter, decoded)
+
+	decoded, err = DecodeExpecting(bytes, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, filter, decoded)
+
+	decoded, err = DecodeExpecting(bytes, 7)
+	assert.EqualError(t, err, "expected tag 7, got 42")
+	assert.Nil(t, decoded)
+}
+
+func TestInsertRecord(t *testing.T) {
+	filter := NewFilter(1 << 16)
+	var log [][]byte
+	for i := 0; i < 1000; i++ {
+		data := []byte("InsertRecord_" + strconv.Itoa(i))
+		assert.True(t, filter.Insert(data))
+		log = append(log, filter.EncodeInsertRecord(data))
+	}
+
+	replayed := NewFilter(1 << 16)
+	for _, record := range log {
+		assert.Nil(t, replayed.ApplyInsertRecord(record))
+	}
+	assert.Equal(t, filter, replayed)
+
+	assert.NotNil(t, replayed.ApplyInsertRecord(nil))
+	assert.NotNil(t, replayed.ApplyInsertRecord(log[0][:2]))
+	assert.NotNil(t, NewFilter(8).ApplyInsertRecord(log[0]))
+}
+
+func TestCompactLog(t *testing.T) {
+	filter := NewFilter(1 << 13)
+	a, b := []byte("CompactLog_a"), []byte("CompactLog_b")
+
+	compacted, err := CompactLog([][]byte{filter.EncodeInsertRecord(a), filter.EncodeDeleteRecord(a)}, filter.BucketPow)
+	assert.Nil(t, err)
+	assert.Empty(t, compacted)
+
+	// a delete before its insert deletes nothing
+	log := [][]byte{
+		filter.EncodeDeleteRecord(b),
+		filter.EncodeInsertRecord(a),
+		filter.EncodeInsertRecord(b),
+		filter.EncodeInsertRecord(a),
+		filter.EncodeDeleteRecord(a),
+	}
+	compacted, err = CompactLog(log, filter.BucketPow)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{filter.EncodeInsertRecord(a), filter.EncodeInsertRecord(b)}, compacted)
+
+	rng := rand.New(rand.NewSource(1))
+	log = nil
+	for i := 0; i < 5000; i++ {
+		data := []byte("CompactLog_" + strconv.Itoa(rng.Intn(2000)))
+		if rng.Intn(3) == 0 {
+			log = append(log, filter.EncodeDeleteRecord(data))
+		} else {
+			log = append(log, filter.EncodeInsertRecord(data))
+		}
+	}
+	compacted, err = CompactLog(log, filter.BucketPow)
+	assert.Nil(t, err)
+	assert.Less(t, len(compacted), len(log))
+	full, short := filter.NewEmptyLike(), filter.NewEmptyLike()
+	for _, record := range log {
+		if record[0] == recordInsert {
+			assert.Nil(t, full.ApplyInsertRecord(record))
+		} else {
+			assert.Nil(t, full.ApplyDeleteRecord(record))
+		}
+	}
+	for _, record := range compacted {
+		assert.Nil(t, short.ApplyInsertRecord(record))
+	}
+	diff, err := full.SymmetricDiffCount(short)
+	assert.Nil(t, err)
+	assert.Zero(t, diff)
+	assert.Equal(t, full.Count, short.Count)
+
+	_, err = CompactLog([][]byte{{recordDelete, 0, 1}}, filter.BucketPow)
+	assert.NotNil(t, err)
+	_, err = CompactLog([][]byte{filter.EncodeInsertRecord(a)}, 2)
+	assert.NotNil(t, err)
+	assert.NotNil(t, filter.ApplyInsertRecord(filter.EncodeDeleteRecord(a)))
+	assert.NotNil(t, filter.ApplyDeleteRecord(filter.EncodeInsertRecord(a)))
+}
+
+func TestDecodePooled(t *testing.T) {
+	var pool sync.Pool
+
+	large := NewFilter(10000)
+	for i := 0; i < 1000; i++ {
+		large.Insert([]byte("DecodePooled_" + strconv.Itoa(i)))
+	}
+	decoded, err := DecodePooled(large.Encode(), &pool)
+	assert.Nil(t, err)
+	assert.Equal(t, large, decoded)
+	decoded.Release(&pool)
+
+	// reusing the larger bucket array must not leak its fingerprints
+	small := NewFilter(1000)
+	small.Insert([]byte("DecodePooled_small"))
+	decoded, err = DecodePooled(small.Encode(), &pool)
+	assert.Nil(t, err)
+	assert.Equal(t, small.Encode(), decoded.Encode())
+	assert.True(t, decoded.Lookup([]byte("DecodePooled_small")))
+
+	_, err = DecodePooled(nil, &pool)
+	assert.True(t, errors.Is(err, ErrEmptyInput))
+
+	// sparse encodings decode into a reused array too, without its
+	// previous fingerprints
+	decoded, err = Decode(large.Encode())
+	assert.Nil(t, err)
+	decoded.Release(&pool)
+	decoded, err = DecodePooled(small.EncodeSparse(), &pool)
+	assert.Nil(t, err)
+	assert.Equal(t, small.Encode(), decoded.Encode())
+	assert.True(t, decoded.Lookup([]byte("DecodePooled_small")))
+
+	// a bucket array too small to be reused goes back to the pool
+	pool = sync.Pool{}
+	decoded, err = Decode(small.Encode())
+	assert.Nil(t, err)
+	decoded.Release(&pool)
+	decoded, err = DecodePooled(large.Encode(), &pool)
+	assert.Nil(t, err)
+	assert.Equal(t, large, decoded)
+	if p, ok := pool.Get().(*[]bucket); assert.True(t, ok) {
+		assert.Len(t, *p, len(small.Buckets))
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	bytes := NewFilter(10000).Encode()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Decode(bytes)
+	}
+}
+
+func BenchmarkDecodePooled(b *testing.B) {
+	var pool sync.Pool
+	bytes := NewFilter(10000).Encode()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cf, _ := DecodePooled(bytes, &pool)
+		cf.Release(&pool)
+	}
+}
+
+func TestParams(t *testing.T) {
+	filter := NewFilterPow(10)
+	params := filter.Params()
+	assert.Equal(t, FilterParams{
+		BucketSize:      4,
+		FingerprintBits: 8,
+		BucketPow:       10,
+		MaxKicks:        maxCuckooCount,
+	}, params)
+
+	decoded, err := Decode(filter.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, params, decoded.Params())
+}
+
+func TestEncodeCanonical(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte("EncodeCanonical_"+strconv.Itoa(i)))
+	}
+	// Keep the load low so no bucket overflows into its alternate.
+	forward, backward := NewFilter(1<<16), NewFilter(1<<16)
+	for i := range keys {
+		forward.Insert(keys[i])
+		backward.Insert(keys[len(keys)-1-i])
+	}
+	assert.Equal(t, forward.EncodeCanonical(), backward.EncodeCanonical())
+
+	decoded, err := Decode(forward.EncodeCanonical())
+	assert.Nil(t, err)
+	for _, key := range keys {
+		assert.True(t, decoded.Lookup(key))
+	}
+}
+
+func TestDecodeChecksumMismatch(t *testing.T) {
+	filter := NewFilter(1000)
+	for i := 0; i < 500; i++ {
+		filter.Insert([]byte(strconv.Itoa(i)))
+	}
+	bytes := filter.Encode()
+	for _, i := range []int{headerSize + 7, len(bytes) - 1} {
+		corrupt := append([]byte(nil), bytes...)
+		corrupt[i] ^= 0x10
+		_, err := Decode(corrupt)
+		assert.True(t, errors.Is(err, ErrChecksumMismatch), "byte %d: %v", i, err)
+	}
+	_, err := Decode(bytes)
+	assert.Nil(t, err)
+}
+
+func TestExportStandard(t *testing.T) {
+	// Two buckets: fingerprints 0x11 and 0x22 in the first, 0x33 in the
+	// last slot of the second.
+	golden := []byte{0x11, 0x22, 0x00, 0x00, 0x00, 0x00, 0x00, 0x33}
+	filter := NewFilterPow(1)
+	filter.Buckets[0][0], filter.Buckets[0][1] = 0x11, 0x22
+	filter.Buckets[1][3] = 0x33
+	exported, err := filter.ExportStandard()
+	assert.Nil(t, err)
+	assert.Equal(t, golden, exported)
+
+	imported, err := ImportStandard(golden, 1, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, filter.Buckets, imported.Buckets)
+	assert.EqualValues(t, 3, imported.CountEntries())
+
+	_, err = ImportStandard(golden, 1, 8)
+	assert.NotNil(t, err)
+	_, err = ImportStandard(golden[1:], 1, 4)
+	assert.NotNil(t, err)
+	_, err = ImportStandard(nil, 64, 4)
+	assert.NotNil(t, err)
+}
+
+func TestExportStandardRoundTrip(t *testing.T) {
+	filter := NewFilter(1000)
+	for i := 0; i < 500; i++ {
+		filter.Insert([]byte(strconv.Itoa(i)))
+	}
+	exported, err := filter.ExportStandard()
+	assert.Nil(t, err)
+	imported, err := ImportStandard(exported, filter.BucketPow, 4)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.True(t, imported.Lookup([]byte(strconv.Itoa(i))))
+	}
+	assert.Equal(t, filter.Encode(), imported.Encode())
+}
+
+func TestEncodeCanonicalGolden(t *testing.T) {
+	// 56 items in 64 slots, so the layout depends on the evictions drawn
+	// from the source.
+	const golden = "434b4f4f020438000000000000000000000000cdd4da4d56638a0737466d00" +
+		"033efc2e30ccfc091718c905a2e0fe909fb4cc3a7cc5d500007ff6122d4ff70d" +
+		"2739e500177f9500607eed00000bbc15a8b6cc53a7b858"
+	for run := 0; run < 3; run++ {
+		filter := NewFilterWithSource(64, rand.NewSource(1))
+		for i := 0; i < 56; i++ {
+			assert.True(t, filter.Insert([]byte("golden_"+strconv.Itoa(i))))
+		}
+		assert.Equal(t, golden, hex.EncodeToString(filter.EncodeCanonical()))
+	}
+}
+
+func TestEncodeByteOrder(t *testing.T) {
+	data := make([]byte, bucketSize<<8)
+	copy(data, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	filter, err := NewFilterFromBuckets(data, 0x0302, 8)
+	assert.Nil(t, err)
+	filter.Tag = 0x0a0b0c0d
+	bytes := filter.Encode()
+
+	// Written out byte by byte, so the test does not depend on the host's
+	// byte order either.
+	header := []byte{
+		'C', 'K', 'O', 'O', encodingVersion, 8,
+		0x02, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x0d, 0x0c, 0x0b, 0x0a,
+	}
+	assert.Equal(t, header, bytes[:headerSize])
+	assert.Equal(t, data, bytes[headerSize:len(bytes)-checksumSize])
+	assert.Equal(t, uint64(0x0302), binary.LittleEndian.Uint64(bytes[6:]))
+	assert.Equal(t, uint32(0x0a0b0c0d), binary.LittleEndian.Uint32(bytes[14:]))
+	n := len(bytes) - checksumSize
+	assert.Equal(t, crc32.ChecksumIEEE(bytes[:n]), binary.LittleEndian.Uint32(bytes[n:]))
+
+	decoded, err := Decode(bytes)
+	assert.Nil(t, err)
+	assert.Equal(t, filter.Buckets, decoded.Buckets)
+	assert.EqualValues(t, 0x0302, decoded.Count)
+	assert.Equal(t, filter.Tag, decoded.Tag)
+}
+
+func TestEncodeSparse(t *testing.T) {
+	filter := NewFilter(1 << 14)
+	filter.Tag = 3
+	n := int(filter.Capacity()) / 20
+	for i := 0; i < n; i++ {
+		filter.Insert([]byte("EncodeSparse_" + strconv.Itoa(i)))
+	}
+	dense, sparse := filter.Encode(), filter.EncodeSparse()
+	assert.Less(t, len(sparse)*5, len(dense))
+	assert.Equal(t, sparse, filter.EncodeSmallest())
+
+	for _, decode := range []func([]byte) (*Filter, error){Decode, DecodeSparse} {
+		decoded, err := decode(sparse)
+		assert.Nil(t, err)
+		assert.Equal(t, filter.Buckets, decoded.Buckets)
+		assert.Equal(t, filter.Count, decoded.Count)
+		assert.Equal(t, filter.Tag, decoded.Tag)
+		assert.Equal(t, filter.OccupiedSlots(), decoded.OccupiedSlots())
+		for i := 0; i < n; i++ {
+			assert.True(t, decoded.Lookup([]byte("EncodeSparse_"+strconv.Itoa(i))))
+		}
+	}
+
+	corrupt := append([]byte(nil), sparse...)
+	corrupt[headerSize+5] ^= 1
+	_, err := Decode(corrupt)
+	assert.True(t, errors.Is(err, ErrChecksumMismatch))
+	_, err = DecodeSparse(dense)
+	assert.True(t, errors.Is(err, ErrBadHeader))
+
+	empty := NewFilter(1000)
+	decoded, err := Decode(empty.EncodeSparse())
+	assert.Nil(t, err)
+	assert.Equal(t, empty.Buckets, decoded.Buckets)
+
+	for i := n; i < 12*n; i++ {
+		filter.Insert([]byte("EncodeSparse_" + strconv.Itoa(i)))
+	}
+	assert.Equal(t, filter.Encode(), filter.EncodeSmallest())
+}
+
+func TestEncodeDecodeEmpty(t *testing.T) {
+	for _, capacity := range []uint{0, 16, 1000, 1 << 16} {
+		filter := NewFilter(capacity)
+		for _, bytes := range [][]byte{filter.Encode(), filter.EncodeSparse()} {
+			decoded, err := Decode(bytes)
+			assert.Nil(t, err)
+			assert.Equal(t, filter, decoded)
+			assert.Equal(t, filter.BucketPow, decoded.BucketPow)
+			assert.EqualValues(t, 0, decoded.CountEntries())
+		}
+	}
+	pow0 := NewFilterPow(0)
+	decoded, err := Decode(pow0.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, pow0, decoded)
+}
+
+func TestDumpLoadText(t *testing.T) {
+	filter := NewFilter(64)
+	filter.Tag = 7
+	for i := 0; i < 40; i++ {
+		filter.Insert([]byte("DumpText_" + strconv.Itoa(i)))
+	}
+	var text strings.Builder
+	assert.Nil(t, filter.DumpText(&text))
+	lines := strings.Split(strings.TrimSuffix(text.String(), "\n"), "\n")
+	assert.Len(t, lines, 1+int(filter.OccupiedSlots()))
+
+	loaded, err := LoadText(strings.NewReader(text.String()))
+	assert.Nil(t, err)
+	assert.Equal(t, filter, loaded)
+
+	for _, bad := range []string{
+		"",
+		"cuckoo bucketPow=x count=0 tag=0\n",
+		"cuckoo bucketPow=1 count=1 tag=0\n2 0 0a\n",
+		"cuckoo bucketPow=1 count=1 tag=0\n0 4 0a\n",
+		"cuckoo bucketPow=1 count=1 tag=0\n0 0 00\n",
+		"cuckoo bucketPow=1 count=2 tag=0\n0 0 0a\n0 0 0b\n",
+	} {
+		_, err := LoadText(strings.NewReader(bad))
+		assert.NotNil(t, err, bad)
+	}
+
+	for _, bad := range []string{
+		"cuckoo bucketPow=1 count=999999 tag=0\n",
+		"cuckoo bucketPow=1 count=9 tag=0\n",
+		"cuckoo bucketPow=1 count=1 tag=0\n0 0 0a\n0 1 0b\n",
+	} {
+		_, err := LoadText(strings.NewReader(bad))
+		assert.True(t, errors.Is(err, ErrBadHeader), "%q: %v", bad, err)
+	}
+	loaded, err = LoadText(strings.NewReader("cuckoo bucketPow=1 count=8 tag=0\n0 0 0a\n"))
+	assert.Nil(t, err)
+	_, err = Decode(loaded.Encode())
+	assert.Nil(t, err)
+}
+
+func TestBuildFromReader(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	input := "alpha\nbeta\r\n\n" + long + "\ngamma"
+	filter, n, err := BuildFromReader(1000, strings.NewReader(input))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	for _, key := range []string{"alpha", "beta", long, "gamma"} {
+		assert.True(t, filter.Lookup([]byte(key)), key)
+	}
+	assert.False(t, filter.Lookup([]byte("beta\r")))
+
+	filter, n, err = BuildFromReader(0, strings.NewReader(strings.Repeat("same\n", 100)))
+	assert.NotNil(t, err)
+	assert.EqualValues(t, filter.CountEntries(), n)
+}
+
+func TestEncodeLayout(t *testing.T) {
+	filter := NewFilterPow(4)
+	for i := range filter.Buckets {
+		for j := 0; j < bucketSize; j++ {
+			filter.insert(fingerprint((i*bucketSize+j)%255+1), uint(i))
+		}
+	}
+	bytes := filter.Encode()
+	payload := bytes[headerSize : len(bytes)-checksumSize]
+	assert.Len(t, payload, len(filter.Buckets)*bucketSize)
+	for i := range filter.Buckets {
+		for j := 0; j < bucketSize; j++ {
+			assert.EqualValues(t, (i*bucketSize+j)%255+1, payload[i*bucketSize+j], "bucket %d slot %d", i, j)
+		}
+	}
+
+	decoded, err := Decode(bytes)
+	assert.Nil(t, err)
+	for i := range decoded.Buckets {
+		for j := 0; j < bucketSize; j++ {
+			assert.Equal(t, fingerprint(payload[i*bucketSize+j]), decoded.Buckets[i][j])
+		}
+	}
+}
+
+func TestIsValidEncoding(t *testing.T) {
+	filter := NewFilter(1000)
+	for i := 0; i < 100; i++ {
+		filter.Insert([]byte("IsValidEncoding_" + strconv.Itoa(i)))
+	}
+	for _, bytes := range [][]byte{filter.Encode(), filter.EncodeSparse(), NewFilterPow(0).Encode()} {
+		assert.True(t, IsValidEncoding(bytes))
+
+		assert.False(t, IsValidEncoding(bytes[:len(bytes)-1]))
+		assert.False(t, IsValidEncoding(bytes[:headerSize]))
+		corrupt := append([]byte(nil), bytes...)
+		corrupt[headerSize]++
+		assert.False(t, IsValidEncoding(corrupt))
+	}
+	assert.False(t, IsValidEncoding(nil))
+	assert.False(t, IsValidEncoding([]byte("definitely not a cuckoo filter")))
+
+	bytes := NewFilter(1 << 16).Encode()
+	assert.Zero(t, testing.AllocsPerRun(10, func() { IsValidEncoding(bytes) }))
+}
+
+func TestDecodeUntrustedHeader(t *testing.T) {
+	filter := NewFilterPow(3)
+	for i := 0; i < 20; i++ {
+		filter.Insert([]byte("untrusted_" + strconv.Itoa(i)))
+	}
+	for _, bytes := range [][]byte{filter.Encode(), filter.EncodeSparse()} {
+		tampered := append([]byte(nil), bytes...)
+		binary.LittleEndian.PutUint64(tampered[6:], uint64(filter.Capacity())+1)
+		putChecksum(tampered)
+		_, err := Decode(tampered)
+		assert.True(t, errors.Is(err, ErrBadHeader), "%v", err)
+		assert.Contains(t, err.Error(), "exceeds capacity")
+		assert.False(t, IsValidEncoding(tampered))
+
+		binary.LittleEndian.PutUint64(tampered[6:], uint64(filter.Capacity()))
+		putChecksum(tampered)
+		_, err = Decode(tampered)
+		assert.Nil(t, err)
+	}
+
+	tampered := filter.Encode()
+	tampered[5]++
+	putChecksum(tampered)
+	_, err := Decode(tampered)
+	assert.True(t, errors.Is(err, ErrBadLength), "%v", err)
+
+	// a sparse encoding claiming 2^28 buckets is only a few bytes long
+	huge := filter.EncodeSparse()
+	huge[5] = 28
+	putChecksum(huge)
+	assert.True(t, IsValidEncoding(huge))
+	_, err = DecodeLimited(huge, 1<<10)
+	assert.NotNil(t, err)
+
+	huge[headerSize] = 100
+	putChecksum(huge)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = Decode(huge)
+	runtime.ReadMemStats(&after)
+	assert.True(t, errors.Is(err, ErrBadLength), "%v", err)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+}
+
+func TestDecodeSparseHeaders(t *testing.T) {
+	filter := NewFilterPow(3)
+	filter.Tag = 7
+	filter.Insert([]byte("DecodeSparseHeaders"))
+	sparse := filter.EncodeSparse()
+
+	decoded, err := DecodeLimited(sparse, len(filter.Buckets))
+	assert.Nil(t, err)
+	assert.True(t, decoded.Lookup([]byte("DecodeSparseHeaders")))
+	_, err = DecodeLimited(sparse, len(filter.Buckets)-1)
+	assert.NotNil(t, err)
+
+	decoded, err = DecodeExpecting(sparse, 7)
+	assert.Nil(t, err)
+	assert.True(t, decoded.Lookup([]byte("DecodeSparseHeaders")))
+	_, err = DecodeExpecting(sparse, 8)
+	assert.NotNil(t, err)
+}
+
+func TestDeletionsCount(t *testing.T) {
+	filter := NewFilter(1000, WithDeletionsInHeader())
+	for i := 0; i < 100; i++ {
+		filter.Insert([]byte("Deletions_" + strconv.Itoa(i)))
+	}
+	for i := 0; i < 10; i++ {
+		assert.True(t, filter.Delete([]byte("Deletions_"+strconv.Itoa(i))))
+	}
+	assert.False(t, filter.Delete([]byte("absent")))
+	assert.EqualValues(t, 10, filter.DeletionsCount())
+	filter.Reset()
+	assert.EqualValues(t, 10, filter.DeletionsCount())
+	filter.Insert([]byte("Deletions_0"))
+	filter.Delete([]byte("Deletions_0"))
+
+	for _, bytes := range [][]byte{filter.Encode(), filter.EncodeSparse()} {
+		assert.EqualValues(t, deletionsVersion, bytes[4])
+		assert.True(t, IsValidEncoding(bytes))
+		decoded, err := Decode(bytes)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 11, decoded.DeletionsCount())
+		assert.True(t, decoded.DeletionsPerformed())
+		assert.Equal(t, bytes[4:deletionsHeaderSize], decoded.Encode()[4:deletionsHeaderSize])
+	}
+
+	// without the option the header stays at version 2
+	plain := NewFilter(1000)
+	plain.Insert([]byte("Deletions_0"))
+	plain.Delete([]byte("Deletions_0"))
+	assert.EqualValues(t, 1, plain.DeletionsCount())
+	decoded, err := Decode(plain.Encode())
+	assert.Nil(t, err)
+	assert.EqualValues(t, encodingVersion, plain.Encode()[4])
+	assert.EqualValues(t, 0, decoded.DeletionsCount())
+	assert.False(t, decoded.DeletionsPerformed())
+
+	insertOnly := NewFilter(1000, WithDeletionsInHeader())
+	insertOnly.Insert([]byte("Deletions_0"))
+	decoded, err = Decode(insertOnly.Encode())
+	assert.Nil(t, err)
+	assert.False(t, decoded.DeletionsPerformed())
+}
+
+func TestEncodeSalt(t *testing.T) {
+	filter := NewFilter(1000, WithSalt(42))
+	for i := 0; i < 100; i++ {
+		filter.Insert([]byte("Salt_" + strconv.Itoa(i)))
+	}
+	for _, bytes := range [][]byte{filter.Encode(), filter.EncodeSparse()} {
+		assert.EqualValues(t, saltVersion, bytes[4])
+		assert.True(t, IsValidEncoding(bytes))
+		decoded, err := Decode(bytes)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 42, decoded.salt)
+		for i := 0; i < 100; i++ {
+			assert.True(t, decoded.Lookup([]byte("Salt_"+strconv.Itoa(i))))
+		}
+		assert.Equal(t, filter.Encode(), decoded.Encode())
+	}
+
+	unsalted := NewFilter(1000)
+	assert.Nil(t, unsalted.SwapFrom(filter.Encode()))
+	assert.True(t, unsalted.Lookup([]byte("Salt_0")))
+
+	tampered := filter.Encode()
+	for i := 26; i < saltHeaderSize; i++ {
+		tampered[i] = 0
+	}
+	putChecksum(tampered)
+	_, err := Decode(tampered)
+	assert.True(t, errors.Is(err, ErrBadHeader), "%v", err)
+
+	assert.NotNil(t, filter.DumpText(ioutil.Discard))
+}
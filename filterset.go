@@ -0,0 +1,104 @@
+package cuckoo
+
+// FilterSet looks keys up in several filters, e.g. one per time window,
+// reporting a key present if any member holds it. Members are checked
+// newest first by default, so when most lookups hit recent windows they
+// stop after the first probe or two.
+type FilterSet struct {
+	// members are in the order they were added
+	members     []*Filter
+	oldestFirst bool
+}
+
+// FilterSetOption configures a FilterSet at construction
+type FilterSetOption func(*FilterSet)
+
+// WithOldestFirst makes lookups check members in the order they were
+// added, for query mixes skewed towards old windows. Results are the same
+// either way.
+func WithOldestFirst() FilterSetOption {
+	return func(fs *FilterSet) {
+		fs.oldestFirst = true
+	}
+}
+
+// NewFilterSet returns an empty FilterSet
+func NewFilterSet(opts ...FilterSetOption) *FilterSet {
+	fs := &FilterSet{}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	return fs
+}
+
+// Add makes filter the newest member. Inserts go to the newest member.
+func (fs *FilterSet) Add(filter *Filter) {
+	fs.members = append(fs.members, filter)
+}
+
+// DropOldest removes and returns the oldest member, or nil if there is
+// none
+func (fs *FilterSet) DropOldest() *Filter {
+	if len(fs.members) == 0 {
+		return nil
+	}
+	oldest := fs.members[0]
+	fs.members[0] = nil
+	fs.members = fs.members[1:]
+	return oldest
+}
+
+// Len returns the number of members
+func (fs *FilterSet) Len() int {
+	return len(fs.members)
+}
+
+// member returns the k-th member in lookup order
+func (fs *FilterSet) member(k int) *Filter {
+	if fs.oldestFirst {
+		return fs.members[k]
+	}
+	return fs.members[len(fs.members)-1-k]
+}
+
+func (fs *FilterSet) Lookup(data []byte) bool {
+	found, _ := fs.lookup(data)
+	return found
+}
+
+// lookup returns whether data is in a member and how many members were
+// probed
+func (fs *FilterSet) lookup(data []byte) (bool, int) {
+	for k := range fs.members {
+		if fs.member(k).Lookup(data) {
+			return true, k + 1
+		}
+	}
+	return false, len(fs.members)
+}
+
+// Insert inserts data into the newest member, failing if there is none
+func (fs *FilterSet) Insert(data []byte) bool {
+	if len(fs.members) == 0 {
+		return false
+	}
+	return fs.members[len(fs.members)-1].Insert(data)
+}
+
+// Delete deletes data from the first member holding it in lookup order
+func (fs *FilterSet) Delete(data []byte) bool {
+	for k := range fs.members {
+		if fs.member(k).Delete(data) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FilterSet) CountEntries() uint {
+	var count uint
+	for _, filter := range fs.members {
+		count += filter.CountEntries()
+	}
+	return count
+}
@@ -0,0 +1,89 @@
+package cuckoo
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const filterSetWindows = 8
+
+// newWindowedSet returns a FilterSet of filterSetWindows members, window w
+// holding the keys "w_i"
+func newWindowedSet(opts ...FilterSetOption) *FilterSet {
+	fs := NewFilterSet(opts...)
+	for w := 0; w < filterSetWindows; w++ {
+		fs.Add(NewFilter(1000))
+		for i := 0; i < 500; i++ {
+			fs.Insert([]byte(strconv.Itoa(w) + "_" + strconv.Itoa(i)))
+		}
+	}
+	return fs
+}
+
+// recentKey returns a key from window w with probability halving for
+// every window further from the newest
+func recentKey(rng *rand.Rand) []byte {
+	w := filterSetWindows - 1
+	for w > 0 && rng.Intn(2) == 0 {
+		w--
+	}
+	return []byte(strconv.Itoa(w) + "_" + strconv.Itoa(rng.Intn(500)))
+}
+
+func TestFilterSet(t *testing.T) {
+	newest, oldest := newWindowedSet(), newWindowedSet(WithOldestFirst())
+	assert.Equal(t, filterSetWindows, newest.Len())
+	assert.EqualValues(t, filterSetWindows*500, newest.CountEntries())
+
+	rng := rand.New(rand.NewSource(1))
+	var newestProbes, oldestProbes int
+	for i := 0; i < 10000; i++ {
+		data := recentKey(rng)
+		found, n := newest.lookup(data)
+		assert.True(t, found)
+		newestProbes += n
+		found, n = oldest.lookup(data)
+		assert.True(t, found)
+		oldestProbes += n
+	}
+	assert.Less(t, newestProbes, oldestProbes)
+	assert.False(t, newest.Lookup([]byte("absent")))
+
+	assert.True(t, newest.Delete([]byte("7_0")))
+	assert.EqualValues(t, filterSetWindows*500-1, newest.CountEntries())
+	dropped := newest.DropOldest()
+	assert.True(t, dropped.Lookup([]byte("0_1")))
+	assert.Equal(t, filterSetWindows-1, newest.Len())
+	assert.EqualValues(t, (filterSetWindows-1)*500-1, newest.CountEntries())
+
+	empty := NewFilterSet()
+	assert.False(t, empty.Insert([]byte("data")))
+	assert.Nil(t, empty.DropOldest())
+}
+
+func benchmarkFilterSetRecent(b *testing.B, fs *FilterSet) {
+	rng := rand.New(rand.NewSource(1))
+	keys := make([][]byte, 1<<12)
+	for i := range keys {
+		keys[i] = recentKey(rng)
+	}
+
+	probes := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, n := fs.lookup(keys[i%len(keys)])
+		probes += n
+	}
+	b.ReportMetric(float64(probes)/float64(b.N), "probes/op")
+}
+
+func BenchmarkFilterSet_NewestFirst(b *testing.B) {
+	benchmarkFilterSetRecent(b, newWindowedSet())
+}
+
+func BenchmarkFilterSet_OldestFirst(b *testing.B) {
+	benchmarkFilterSetRecent(b, newWindowedSet(WithOldestFirst()))
+}
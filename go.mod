@@ -6,5 +6,6 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgryski/go-metro v0.0.0-20200812162917-85c65e2d0165
 	github.com/stretchr/testify v1.6.1
+	golang.org/x/text v0.3.8
 	gopkg.in/yaml.v3 v3.0.0-20200605160147-a5ece683394c // indirect
 )
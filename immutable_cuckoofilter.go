@@ -0,0 +1,28 @@
+package cuckoo
+
+// ImmutableFilter is a read-only snapshot of a Filter. It exposes no
+// mutating methods, so it can be shared across goroutines.
+type ImmutableFilter struct {
+	filter *Filter
+}
+
+// Freeze returns a read-only snapshot of the counter. Later changes to cf
+// are not visible through the snapshot.
+func (cf *Filter) Freeze() *ImmutableFilter {
+	filter := *cf
+	filter.Buckets = make([]bucket, len(cf.Buckets))
+	copy(filter.Buckets, cf.Buckets)
+	return &ImmutableFilter{filter: &filter}
+}
+
+func (f *ImmutableFilter) Lookup(data []byte) bool {
+	return f.filter.Lookup(data)
+}
+
+func (f *ImmutableFilter) CountEntries() uint {
+	return f.filter.CountEntries()
+}
+
+func (f *ImmutableFilter) Encode() []byte {
+	return f.filter.Encode()
+}
@@ -0,0 +1,34 @@
+package cuckoo
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImmutableFilter(t *testing.T) {
+	filter := NewFilter(10000)
+	for i := 0; i < 1000; i++ {
+		filter.Insert([]byte("ImmutableFilter_" + strconv.Itoa(i)))
+	}
+	frozen := filter.Freeze()
+
+	typ := reflect.TypeOf(frozen)
+	for _, name := range []string{"Insert", "InsertUnique", "Delete", "Reset"} {
+		_, ok := typ.MethodByName(name)
+		assert.False(t, ok, name)
+	}
+
+	for i := 0; i < 2000; i++ {
+		data := []byte("ImmutableFilter_" + strconv.Itoa(i))
+		assert.Equal(t, filter.Lookup(data), frozen.Lookup(data))
+	}
+	assert.Equal(t, filter.CountEntries(), frozen.CountEntries())
+	assert.Equal(t, filter.Encode(), frozen.Encode())
+
+	filter.Reset()
+	assert.True(t, frozen.Lookup([]byte("ImmutableFilter_1")))
+	assert.EqualValues(t, 1000, frozen.CountEntries())
+}
@@ -0,0 +1,122 @@
+package cuckoo
+
+import (
+	"fmt"
+	"sync"
+)
+
+// NewFilterParallel returns a new cuckoofilter with a given capacity
+// holding items, using up to workers goroutines.
+//
+// The items are hashed in parallel and sharded by the range their primary
+// bucket index falls in. Each worker then places the items of its shard,
+// writing only to the buckets in its own range: an item goes to its
+// primary bucket, or to its alternate bucket when that is in the same
+// range. Items that need an eviction or a bucket owned by another worker
+// are inserted sequentially afterwards with the usual bounded eviction
+// chain, so displacement never crosses shards concurrently.
+//
+// The options apply as they do to Insert: keys are transformed and salted
+// before hashing, direct placements are recorded in the eviction histogram
+// as inserts without evictions, and the victim policy, random source and
+// eviction budget govern the sequential inserts. Only the resulting layout
+// differs from inserting the items in order. With WithCollapseDuplicates,
+// items whose candidate buckets fall in different ranges are all inserted
+// sequentially, so a copy stored by another worker is always seen.
+//
+// An error is returned if any item could not be inserted.
+func NewFilterParallel(capacity uint, items [][]byte, workers int, opts ...FilterOption) (*Filter, error) {
+	cf := NewFilter(capacity, opts...)
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(cf.Buckets) {
+		workers = len(cf.Buckets)
+	}
+
+	type entry struct {
+		i  uint
+		fp fingerprint
+	}
+	entries := make([]entry, len(items))
+	var wg sync.WaitGroup
+	chunk := (len(items) + workers - 1) / workers
+	for lo := 0; lo < len(items); lo += chunk {
+		hi := lo + chunk
+		if hi > len(items) {
+			hi = len(items)
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			for k := lo; k < hi; k++ {
+				i, fp := cf.getIndexAndFingerprint(items[k])
+				entries[k] = entry{i, fp}
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+
+	shardSize := (uint(len(cf.Buckets)) + uint(workers) - 1) / uint(workers)
+	shards := make([][]entry, workers)
+	for _, e := range entries {
+		w := e.i / shardSize
+		shards[w] = append(shards[w], e)
+	}
+
+	deferred := make([][]entry, workers)
+	counts := make([]uint, workers)
+	for w := range shards {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			lo, hi := uint(w)*shardSize, uint(w+1)*shardSize
+			for _, e := range shards[w] {
+				i2 := getAltIndex(e.fp, e.i, cf.BucketPow)
+				inShard := i2 >= lo && i2 < hi
+				if cf.collapseDuplicates {
+					// the alternate must be readable to look for a copy
+					if !inShard {
+						deferred[w] = append(deferred[w], e)
+						continue
+					}
+					if cf.contains(e.fp, e.i) {
+						continue
+					}
+				}
+				if cf.Buckets[e.i].insert(e.fp) {
+					counts[w]++
+					continue
+				}
+				if inShard && cf.Buckets[i2].insert(e.fp) {
+					counts[w]++
+					continue
+				}
+				deferred[w] = append(deferred[w], e)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, count := range counts {
+		cf.Count += count
+		if cf.evictions != nil && count > 0 {
+			cf.evictions[0] += int(count)
+		}
+	}
+	var failed int
+	for _, shard := range deferred {
+		for _, e := range shard {
+			if cf.collapses(e.fp, e.i) {
+				continue
+			}
+			if ok, _, _ := cf.insertFingerprint(e.fp, e.i); !ok {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		return nil, fmt.Errorf("failed to insert %d of %d items, capacity %d is too small", failed, len(items), capacity)
+	}
+	return cf, nil
+}
@@ -0,0 +1,52 @@
+package cuckoo
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFilterParallel(t *testing.T) {
+	const n = 50000
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = []byte("NewFilterParallel_" + strconv.Itoa(i))
+	}
+
+	sequential := NewFilter(2 * n)
+	for _, item := range items {
+		assert.True(t, sequential.Insert(item))
+	}
+	for _, workers := range []int{1, 4, 7} {
+		parallel, err := NewFilterParallel(2*n, items, workers)
+		assert.Nil(t, err)
+		assert.Equal(t, sequential.CountEntries(), parallel.CountEntries())
+		assert.Equal(t, sequential.BucketPow, parallel.BucketPow)
+		for _, item := range items {
+			assert.True(t, parallel.Lookup(item))
+		}
+	}
+
+	_, err := NewFilterParallel(8, items, 4)
+	assert.NotNil(t, err)
+}
+
+func TestNewFilterParallelOptions(t *testing.T) {
+	const n = 20000
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = []byte("NewFilterParallelOptions_" + strconv.Itoa(i))
+	}
+	parallel, err := NewFilterParallel(n, items, 4, WithEvictionHistogram(), WithSalt(9), WithMaxKicks(100))
+	assert.Nil(t, err)
+	var inserts int
+	for _, count := range parallel.EvictionHistogram() {
+		inserts += count
+	}
+	assert.Equal(t, n, inserts)
+	assert.Greater(t, len(parallel.EvictionHistogram()), 1)
+	for _, item := range items {
+		assert.True(t, parallel.Lookup(item))
+	}
+}
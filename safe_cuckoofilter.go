@@ -0,0 +1,91 @@
+package cuckoo
+
+import "sync"
+
+// SafeFilter is a Filter guarded by a single RWMutex, so it is safe for
+// concurrent use. Lookups run in parallel; every mutation is exclusive.
+type SafeFilter struct {
+	mu     sync.RWMutex
+	filter *Filter
+}
+
+// NewSafeFilter returns a new SafeFilter with a given capacity
+func NewSafeFilter(capacity uint, opts ...FilterOption) *SafeFilter {
+	return &SafeFilter{filter: NewFilter(capacity, opts...)}
+}
+
+func (sf *SafeFilter) Lookup(data []byte) bool {
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+	return sf.filter.Lookup(data)
+}
+
+func (sf *SafeFilter) Insert(data []byte) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.filter.Insert(data)
+}
+
+func (sf *SafeFilter) InsertUnique(data []byte) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.filter.InsertUnique(data)
+}
+
+func (sf *SafeFilter) Delete(data []byte) bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.filter.Delete(data)
+}
+
+func (sf *SafeFilter) CountEntries() uint {
+	sf.mu.RLock()
+	defer sf.mu.RUnlock()
+	return sf.filter.CountEntries()
+}
+
+// Reset empties the filter, zeroing the buckets in place under the write
+// lock
+func (sf *SafeFilter) Reset() {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.filter.Reset()
+}
+
+// ResetFast empties the filter like Reset, but allocates a zeroed bucket
+// array before taking the write lock and only swaps it in while holding it,
+// so lookups on huge filters are blocked for a moment rather than for a
+// full pass over the buckets. The old array is left to the garbage
+// collector.
+func (sf *SafeFilter) ResetFast() {
+	sf.mu.RLock()
+	n := len(sf.filter.Buckets)
+	sf.mu.RUnlock()
+	buckets := make([]bucket, n)
+
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if len(sf.filter.Buckets) != n {
+		buckets = make([]bucket, len(sf.filter.Buckets))
+	}
+	sf.filter.Buckets = buckets
+	sf.filter.Count = 0
+	sf.filter.skew = 0
+	sf.filter.deleted = false
+	sf.filter.lost = false
+}
+
+// SwapFrom replaces the contents of the filter with an encoded filter like
+// Filter.SwapFrom. Decoding happens before taking the write lock, which is
+// held only for the swap, so concurrent lookups see either the old or the
+// new contents.
+func (sf *SafeFilter) SwapFrom(bytes []byte) error {
+	filter, err := Decode(bytes)
+	if err != nil {
+		return err
+	}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.filter.swap(filter)
+	return nil
+}
@@ -0,0 +1,89 @@
+package cuckoo
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafeFilterResetFast(t *testing.T) {
+	const n = 5000
+	filter := NewSafeFilter(n)
+	for i := 0; i < n; i++ {
+		assert.True(t, filter.Insert([]byte("SafeFilter_"+strconv.Itoa(i))))
+	}
+	assert.EqualValues(t, n, filter.CountEntries())
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				filter.Lookup([]byte("SafeFilter_" + strconv.Itoa(i%n)))
+				filter.CountEntries()
+			}
+		}()
+	}
+	filter.ResetFast()
+	close(stop)
+	wg.Wait()
+
+	assert.EqualValues(t, 0, filter.CountEntries())
+	for i := 0; i < n; i++ {
+		assert.False(t, filter.Lookup([]byte("SafeFilter_"+strconv.Itoa(i))))
+	}
+	assert.True(t, filter.Insert([]byte("SafeFilter_0")))
+	assert.True(t, filter.Lookup([]byte("SafeFilter_0")))
+	assert.EqualValues(t, 1, filter.filter.OccupiedSlots())
+}
+
+func TestSafeFilterSwapFrom(t *testing.T) {
+	const n = 1500
+	filter := NewSafeFilter(2 * n)
+	next := NewFilter(2 * n)
+	for i := 0; i < n; i++ {
+		assert.True(t, filter.Insert([]byte("old_"+strconv.Itoa(i))))
+		assert.True(t, next.Insert([]byte("new_"+strconv.Itoa(i))))
+	}
+	blob := next.Encode()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := strconv.Itoa(i % n)
+				// the old and the new contents each hold one of the keys
+				if !filter.Lookup([]byte("old_"+key)) && !filter.Lookup([]byte("new_"+key)) {
+					t.Errorf("key %s missing from both contents", key)
+					return
+				}
+				assert.EqualValues(t, n, filter.CountEntries())
+			}
+		}()
+	}
+	assert.Nil(t, filter.SwapFrom(blob))
+	assert.NotNil(t, filter.SwapFrom(blob[:len(blob)-1]))
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		assert.True(t, filter.Lookup([]byte("new_"+strconv.Itoa(i))))
+	}
+}
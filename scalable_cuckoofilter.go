@@ -3,6 +3,9 @@ package cuckoo
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
 )
 
 const (
@@ -10,15 +13,58 @@ const (
 	DefaultCapacity   = 10000
 )
 
+// ScalableCuckooFilter grows by adding filters. A Filter cannot be resized
+// in place since its fingerprints do not keep enough of the hash to find
+// their buckets in a larger table, so growth chains a new, larger filter
+// once the last one's load factor exceeds loadFactor, before its inserts
+// start failing.
 type ScalableCuckooFilter struct {
 	filters    []*Filter
 	loadFactor float32
 	//when scale(last filter size * loadFactor >= capacity) get new filter capacity
 	scaleFactor func(capacity uint) uint
+	// maxBytes caps the memory of all filters when non-zero
+	maxBytes uint64
+	// expectedItems sizes the initial filter when non-zero
+	expectedItems uint
 }
 
 type option func(*ScalableCuckooFilter)
 
+// ErrMemoryBudgetExceeded is returned when growing would exceed the budget
+// set with WithMaxBytes
+var ErrMemoryBudgetExceeded = errors.New("memory budget exceeded")
+
+// WithExpectedItems sizes the initial filter to hold n items below the
+// load factor, so loading that many items right away never grows the
+// filter
+func WithExpectedItems(n uint) option {
+	return func(filter *ScalableCuckooFilter) {
+		filter.expectedItems = n
+	}
+}
+
+// WithAutoGrowAt makes the filter grow once the load factor of its last
+// filter exceeds loadFactor, DefaultLoadFactor by default. Values outside
+// (0, 1] are ignored. Lower values grow sooner, trading memory for shorter
+// eviction chains and fewer false positives per filter.
+func WithAutoGrowAt(loadFactor float32) option {
+	return func(filter *ScalableCuckooFilter) {
+		if loadFactor > 0 && loadFactor <= 1 {
+			filter.loadFactor = loadFactor
+		}
+	}
+}
+
+// WithMaxBytes stops the filter from growing once the buckets of all its
+// filters would take more than maxBytes bytes. The initial filter is always
+// allocated.
+func WithMaxBytes(maxBytes uint64) option {
+	return func(filter *ScalableCuckooFilter) {
+		filter.maxBytes = maxBytes
+	}
+}
+
 type Store struct {
 	Bytes      [][]byte
 	LoadFactor float32
@@ -58,20 +104,71 @@ func (sf *ScalableCuckooFilter) Reset() {
 }
 
 func (sf *ScalableCuckooFilter) Insert(data []byte) bool {
+	return sf.TryInsert(data) == nil
+}
+
+// TryInsert inserts data like Insert, returning ErrMemoryBudgetExceeded
+// when the filter needs to grow past the budget set with WithMaxBytes
+func (sf *ScalableCuckooFilter) TryInsert(data []byte) error {
 	needScale := false
 	lastFilter := sf.filters[len(sf.filters)-1]
-	if (float32(lastFilter.Count) / float32(len(lastFilter.Buckets))) > sf.loadFactor {
+	if lastFilter.LoadFactor() > float64(sf.loadFactor) {
 		needScale = true
 	} else {
 		b := lastFilter.Insert(data)
 		needScale = !b
 	}
 	if !needScale {
-		return true
+		return nil
+	}
+	newFilter, err := sf.grow(sf.scaleFactor(uint(len(lastFilter.Buckets))))
+	if err != nil {
+		return err
+	}
+	if !newFilter.Insert(data) {
+		return fmt.Errorf("failed to insert, filter is full")
 	}
-	newFilter := NewFilter(sf.scaleFactor(uint(len(lastFilter.Buckets))))
+	return nil
+}
+
+// grow adds a filter with the given capacity unless it exceeds maxBytes
+func (sf *ScalableCuckooFilter) grow(capacity uint) (*Filter, error) {
+	if sf.maxBytes > 0 {
+		size := uint64(bucketSize) << getBucketPow(capacity)
+		if used := sf.MemoryBytes(); used+size > sf.maxBytes {
+			return nil, fmt.Errorf("%w: growing by %d bytes to %d, budget is %d", ErrMemoryBudgetExceeded, size, used+size, sf.maxBytes)
+		}
+	}
+	newFilter := NewFilter(capacity)
 	sf.filters = append(sf.filters, newFilter)
-	return newFilter.Insert(data)
+	return newFilter, nil
+}
+
+// MemoryBytes returns the number of bytes taken by the buckets of all
+// filters
+func (sf *ScalableCuckooFilter) MemoryBytes() uint64 {
+	var sum uint64
+	for _, filter := range sf.filters {
+		sum += filter.MemoryUsage()
+	}
+	return sum
+}
+
+// Reserve makes room for additional more inserts without further growth.
+// If the last filter cannot take them below loadFactor, a single filter
+// large enough for all of them is added.
+func (sf *ScalableCuckooFilter) Reserve(additional uint) error {
+	lastFilter := sf.filters[len(sf.filters)-1]
+	limit := float64(sf.loadFactor) * float64(len(lastFilter.Buckets)*bucketSize)
+	if float64(lastFilter.Count)+float64(additional) <= limit {
+		return nil
+	}
+	slots := math.Ceil(float64(additional) / float64(sf.loadFactor))
+	if slots > float64(uint64(bucketSize)<<maxBucketPow) {
+		return fmt.Errorf("can not reserve %d items, exceeds maximum filter size", additional)
+	}
+	_, err := sf.grow(uint(slots))
+	return err
 }
 
 func (sf *ScalableCuckooFilter) InsertUnique(data []byte) bool {
@@ -164,7 +261,11 @@ func configure(sfilter *ScalableCuckooFilter) {
 		}
 	}
 	if sfilter.filters == nil {
-		initFilter := NewFilter(DefaultCapacity)
+		capacity := uint(DefaultCapacity)
+		if sfilter.expectedItems > 0 {
+			capacity = uint(math.Ceil(float64(sfilter.expectedItems) / float64(sfilter.loadFactor)))
+		}
+		initFilter := NewFilter(capacity)
 		sfilter.filters = []*Filter{initFilter}
 	}
 }
@@ -1,6 +1,7 @@
 package cuckoo
 
 import (
+	"errors"
 	"strconv"
 	"testing"
 )
@@ -40,7 +41,100 @@ func TestScalableCuckooFilter_DecodeEncode(t *testing.T) {
 	b := decodeFilter.Lookup([]byte("NewScalableCuckooFilter_233"))
 	assert.True(t, b)
 	for i, f := range decodeFilter.filters {
-		assert.Equal(t, f.count, filter.filters[i].count)
+		assert.Equal(t, f.Count, filter.filters[i].Count)
 	}
 
 }
+
+func TestScalableCuckooFilter_AutoGrow(t *testing.T) {
+	filter := NewScalableCuckooFilter()
+	const n = 20 * DefaultCapacity
+	for i := 0; i < n; i++ {
+		assert.True(t, filter.Insert([]byte("AutoGrow_"+strconv.Itoa(i))))
+	}
+	assert.EqualValues(t, n, filter.CountEntries())
+	assert.Greater(t, len(filter.filters), 1)
+	for _, f := range filter.filters[:len(filter.filters)-1] {
+		assert.InDelta(t, DefaultLoadFactor, f.LoadFactor(), 0.01)
+	}
+	for i := 0; i < n; i++ {
+		assert.True(t, filter.Lookup([]byte("AutoGrow_"+strconv.Itoa(i))))
+	}
+}
+
+func TestScalableCuckooFilter_AutoGrowAt(t *testing.T) {
+	filter := NewScalableCuckooFilter(WithAutoGrowAt(0.5))
+	for i := 0; len(filter.filters) == 1; i++ {
+		assert.True(t, filter.Insert([]byte("AutoGrowAt_"+strconv.Itoa(i))))
+	}
+	assert.InDelta(t, 0.5, filter.filters[0].LoadFactor(), 0.01)
+
+	for _, invalid := range []float32{-0.5, 0, 1.5} {
+		filter := NewScalableCuckooFilter(WithAutoGrowAt(invalid))
+		assert.Equal(t, float32(DefaultLoadFactor), filter.loadFactor)
+	}
+}
+
+func TestScalableCuckooFilter_Reserve(t *testing.T) {
+	filter := NewScalableCuckooFilter()
+	for i := 0; i < 1000; i++ {
+		filter.Insert([]byte("Reserve_" + strconv.Itoa(i)))
+	}
+	assert.Nil(t, filter.Reserve(100))
+	assert.Len(t, filter.filters, 1)
+
+	const additional = 50000
+	assert.Nil(t, filter.Reserve(additional))
+	assert.Len(t, filter.filters, 2)
+	for i := 1000; i < 1000+additional; i++ {
+		assert.True(t, filter.Insert([]byte("Reserve_"+strconv.Itoa(i))))
+	}
+	assert.Len(t, filter.filters, 2)
+	for i := 0; i < 1000+additional; i++ {
+		assert.True(t, filter.Lookup([]byte("Reserve_"+strconv.Itoa(i))))
+	}
+
+	assert.NotNil(t, filter.Reserve(^uint(0)))
+}
+
+func TestScalableCuckooFilter_MaxBytes(t *testing.T) {
+	// The initial 16KiB filter and a 32KiB second one fit, a 64KiB third
+	// does not.
+	const budget = 100 << 10
+	filter := NewScalableCuckooFilter(WithMaxBytes(budget))
+	var err error
+	var inserted int
+	for ; err == nil; inserted++ {
+		err = filter.TryInsert([]byte("MaxBytes_" + strconv.Itoa(inserted)))
+	}
+	assert.True(t, errors.Is(err, ErrMemoryBudgetExceeded))
+	assert.Len(t, filter.filters, 2)
+	assert.LessOrEqual(t, filter.MemoryBytes(), uint64(budget))
+	assert.EqualValues(t, inserted-1, filter.CountEntries())
+
+	assert.False(t, filter.Insert([]byte("MaxBytes_again")))
+	assert.True(t, errors.Is(filter.TryInsert([]byte("MaxBytes_again")), ErrMemoryBudgetExceeded))
+	assert.True(t, errors.Is(filter.Reserve(1<<20), ErrMemoryBudgetExceeded))
+	assert.Len(t, filter.filters, 2)
+	for i := 0; i < inserted-1; i++ {
+		assert.True(t, filter.Lookup([]byte("MaxBytes_"+strconv.Itoa(i))))
+	}
+}
+
+func TestScalableCuckooFilter_ExpectedItems(t *testing.T) {
+	for _, n := range []int{1000, 7372, 50000} {
+		filter := NewScalableCuckooFilter(WithExpectedItems(uint(n)))
+		for i := 0; i < n; i++ {
+			assert.True(t, filter.Insert([]byte("ExpectedItems_"+strconv.Itoa(i))))
+		}
+		assert.Len(t, filter.filters, 1, "%d items", n)
+
+		grown := NewScalableCuckooFilter()
+		for i := 0; i < n; i++ {
+			grown.Insert([]byte("ExpectedItems_" + strconv.Itoa(i)))
+		}
+		if n > DefaultCapacity {
+			assert.Greater(t, len(grown.filters), 1)
+		}
+	}
+}
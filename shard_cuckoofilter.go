@@ -0,0 +1,74 @@
+package cuckoo
+
+import "fmt"
+
+// FilterShard holds a contiguous range of a Filter's buckets, as returned by
+// Split. Bucket indices stay absolute: a shard answers for the buckets in
+// [Offset(), Offset()+Len()).
+//
+// An item's two candidate buckets are picked by its hash and fingerprint
+// and can fall into different shards, and evictions may have left it in
+// either one. Route a lookup to the shards of both indices returned by
+// CandidateIndices; the item is found in the shard holding the bucket it
+// is stored in. Shards are read-only, since an eviction chain can cross
+// any number of shard boundaries.
+type FilterShard struct {
+	buckets      []bucket
+	offset       uint
+	bucketPow    uint
+	salt         uint64
+	keyTransform func([]byte) []byte
+}
+
+// Split partitions the filter's buckets by index range into n shards of
+// equal size. n must divide the number of buckets, so it is a power of two
+// no larger than it. The shards copy the buckets; cf is unchanged.
+func (cf *Filter) Split(n int) ([]*FilterShard, error) {
+	if n < 1 || n > len(cf.Buckets) || len(cf.Buckets)%n != 0 {
+		return nil, fmt.Errorf("can not split %d buckets into %d shards", len(cf.Buckets), n)
+	}
+	size := len(cf.Buckets) / n
+	shards := make([]*FilterShard, n)
+	for s := range shards {
+		buckets := make([]bucket, size)
+		copy(buckets, cf.Buckets[s*size:])
+		shards[s] = &FilterShard{
+			buckets:      buckets,
+			offset:       uint(s * size),
+			bucketPow:    cf.BucketPow,
+			salt:         cf.salt,
+			keyTransform: cf.keyTransform,
+		}
+	}
+	return shards, nil
+}
+
+// Offset returns the index of the shard's first bucket
+func (fs *FilterShard) Offset() uint {
+	return fs.offset
+}
+
+// Len returns the number of buckets in the shard
+func (fs *FilterShard) Len() uint {
+	return uint(len(fs.buckets))
+}
+
+// Holds returns whether bucket index belongs to the shard
+func (fs *FilterShard) Holds(index uint) bool {
+	return index >= fs.offset && index-fs.offset < uint(len(fs.buckets))
+}
+
+// Lookup returns true if data's fingerprint is in one of its candidate
+// buckets held by the shard
+func (fs *FilterShard) Lookup(data []byte) bool {
+	if fs.keyTransform != nil {
+		data = fs.keyTransform(data)
+	}
+	i1, fp := getSaltedIndexAndFingerprint(data, fs.bucketPow, fs.salt)
+	for _, i := range [2]uint{i1, getAltIndex(fp, i1, fs.bucketPow)} {
+		if fs.Holds(i) && fs.buckets[i-fs.offset].getFingerprintIndex(fp) > -1 {
+			return true
+		}
+	}
+	return false
+}
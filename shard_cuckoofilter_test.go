@@ -0,0 +1,48 @@
+package cuckoo
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplit(t *testing.T) {
+	filter := NewFilter(1 << 12)
+	var keys [][]byte
+	for i := 0; i < 3500; i++ {
+		data := []byte("Split_" + strconv.Itoa(i))
+		if filter.Insert(data) {
+			keys = append(keys, data)
+		}
+	}
+
+	_, err := filter.Split(3)
+	assert.Error(t, err)
+	_, err = filter.Split(0)
+	assert.Error(t, err)
+
+	const n = 8
+	shards, err := filter.Split(n)
+	assert.NoError(t, err)
+	assert.Len(t, shards, n)
+	size := uint(len(filter.Buckets) / n)
+	for s, shard := range shards {
+		assert.EqualValues(t, uint(s)*size, shard.Offset())
+		assert.EqualValues(t, size, shard.Len())
+	}
+
+	for _, data := range keys {
+		i1, i2 := filter.CandidateIndices(data)
+		found := 0
+		for s, shard := range shards {
+			routed := shard.Holds(i1) || shard.Holds(i2)
+			assert.Equal(t, routed, s == int(i1/size) || s == int(i2/size))
+			if shard.Lookup(data) {
+				assert.True(t, routed, "%s found in shard %d", data, s)
+				found++
+			}
+		}
+		assert.NotZero(t, found, "%s not found in any shard", data)
+	}
+}
@@ -0,0 +1,174 @@
+package cuckoo
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// StripedFilter is a Filter safe for concurrent use, with a configurable
+// number of lock stripes so operations on different buckets proceed in
+// parallel. Bucket i is guarded by stripe i % stripes.
+//
+// Inserts and deletes that only touch an item's two candidate buckets lock
+// just those stripes. An insert that has to evict runs a chain that can
+// reach any bucket, so it takes the exclusive evict lock instead, which
+// waits for every other operation. Locks are always taken in the same
+// order, the evict lock first and then stripes in ascending order, so
+// operations can not deadlock.
+type StripedFilter struct {
+	filter  *Filter
+	evict   sync.RWMutex
+	stripes []sync.RWMutex
+	// inserted and deleted count the inserts and deletes done outside the
+	// evict lock, which fold moves into the filter's own counters.
+	inserted int64
+	deleted  int64
+}
+
+// NewStripedFilter returns a new StripedFilter with a given capacity and
+// number of lock stripes
+func NewStripedFilter(capacity uint, stripes int, opts ...FilterOption) *StripedFilter {
+	if stripes < 1 {
+		stripes = 1
+	}
+	return &StripedFilter{
+		filter:  NewFilter(capacity, opts...),
+		stripes: make([]sync.RWMutex, stripes),
+	}
+}
+
+// lockedStripes returns the stripes guarding buckets i1 and i2 in locking
+// order, s2 being -1 when both share a stripe
+func (sf *StripedFilter) lockedStripes(i1, i2 uint) (s1, s2 int) {
+	s1, s2 = int(i1%uint(len(sf.stripes))), int(i2%uint(len(sf.stripes)))
+	if s1 == s2 {
+		return s1, -1
+	}
+	if s1 > s2 {
+		s1, s2 = s2, s1
+	}
+	return s1, s2
+}
+
+// fold moves the inserts and deletes done outside the evict lock into the
+// filter's Count, Deletions and eviction histogram. The evict lock must be
+// held exclusively.
+func (sf *StripedFilter) fold() {
+	cf := sf.filter
+	inserted, deleted := uint(atomic.SwapInt64(&sf.inserted, 0)), uint(atomic.SwapInt64(&sf.deleted, 0))
+	cf.Count = cf.Count + inserted - deleted
+	cf.Deletions += deleted
+	if deleted > 0 {
+		cf.deleted = true
+	}
+	if cf.evictions != nil && inserted > 0 {
+		cf.evictions[0] += int(inserted)
+	}
+}
+
+func (sf *StripedFilter) lock(s1, s2 int) {
+	sf.stripes[s1].Lock()
+	if s2 >= 0 {
+		sf.stripes[s2].Lock()
+	}
+}
+
+func (sf *StripedFilter) unlock(s1, s2 int) {
+	if s2 >= 0 {
+		sf.stripes[s2].Unlock()
+	}
+	sf.stripes[s1].Unlock()
+}
+
+func (sf *StripedFilter) Lookup(data []byte) bool {
+	i1, fp := sf.filter.getIndexAndFingerprint(data)
+	i2 := getAltIndex(fp, i1, sf.filter.BucketPow)
+	s1, s2 := sf.lockedStripes(i1, i2)
+
+	sf.evict.RLock()
+	defer sf.evict.RUnlock()
+	sf.stripes[s1].RLock()
+	defer sf.stripes[s1].RUnlock()
+	if s2 >= 0 {
+		sf.stripes[s2].RLock()
+		defer sf.stripes[s2].RUnlock()
+	}
+	return sf.filter.Buckets[i1].getFingerprintIndex(fp) > -1 ||
+		sf.filter.Buckets[i2].getFingerprintIndex(fp) > -1
+}
+
+func (sf *StripedFilter) Insert(data []byte) bool {
+	i1, fp := sf.filter.getIndexAndFingerprint(data)
+	i2 := getAltIndex(fp, i1, sf.filter.BucketPow)
+	s1, s2 := sf.lockedStripes(i1, i2)
+
+	sf.evict.RLock()
+	sf.lock(s1, s2)
+	collapsed := sf.filter.collapses(fp, i1)
+	ok := collapsed || sf.filter.Buckets[i1].insert(fp) || sf.filter.Buckets[i2].insert(fp)
+	sf.unlock(s1, s2)
+	sf.evict.RUnlock()
+	if ok {
+		if !collapsed {
+			atomic.AddInt64(&sf.inserted, 1)
+		}
+		return true
+	}
+
+	sf.evict.Lock()
+	defer sf.evict.Unlock()
+	sf.fold()
+	if sf.filter.collapses(fp, i1) {
+		return true
+	}
+	ok, _, _ = sf.filter.insertFingerprint(fp, i1)
+	return ok
+}
+
+func (sf *StripedFilter) Delete(data []byte) bool {
+	i1, fp := sf.filter.getIndexAndFingerprint(data)
+	i2 := getAltIndex(fp, i1, sf.filter.BucketPow)
+	s1, s2 := sf.lockedStripes(i1, i2)
+
+	sf.evict.RLock()
+	defer sf.evict.RUnlock()
+	sf.lock(s1, s2)
+	defer sf.unlock(s1, s2)
+	if sf.filter.Buckets[i1].delete(fp) || sf.filter.Buckets[i2].delete(fp) {
+		atomic.AddInt64(&sf.deleted, 1)
+		return true
+	}
+	return false
+}
+
+func (sf *StripedFilter) CountEntries() uint {
+	sf.evict.RLock()
+	defer sf.evict.RUnlock()
+	return uint(int64(sf.filter.Count) + atomic.LoadInt64(&sf.inserted) - atomic.LoadInt64(&sf.deleted))
+}
+
+// LoadFactor returns the fraction of slots in use, see Filter.LoadFactor.
+// It waits for every other operation, like an insert that evicts.
+func (sf *StripedFilter) LoadFactor() float64 {
+	sf.evict.Lock()
+	defer sf.evict.Unlock()
+	sf.fold()
+	return sf.filter.LoadFactor()
+}
+
+// DeletionsPerformed returns whether a fingerprint has been deleted since
+// the filter was created or last Reset, see Filter.DeletionsPerformed. It
+// waits for every other operation, like an insert that evicts.
+func (sf *StripedFilter) DeletionsPerformed() bool {
+	sf.evict.Lock()
+	defer sf.evict.Unlock()
+	sf.fold()
+	return sf.filter.DeletionsPerformed()
+}
+
+func (sf *StripedFilter) Reset() {
+	sf.evict.Lock()
+	defer sf.evict.Unlock()
+	sf.fold()
+	sf.filter.Reset()
+}
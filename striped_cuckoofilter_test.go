@@ -0,0 +1,52 @@
+package cuckoo
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripedFilter(t *testing.T) {
+	const (
+		workers = 8
+		perWork = 2000
+	)
+	filter := NewStripedFilter(workers*perWork, 16)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWork; i++ {
+				data := []byte("StripedFilter_" + strconv.Itoa(w) + "_" + strconv.Itoa(i))
+				assert.True(t, filter.Insert(data))
+				assert.True(t, filter.Lookup(data))
+				if i%4 == 0 {
+					assert.True(t, filter.Delete(data))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, workers*perWork*3/4, filter.CountEntries())
+	assert.InDelta(t, float64(workers*perWork*3/4)/float64(filter.filter.Capacity()), filter.LoadFactor(), 1e-9)
+	assert.True(t, filter.DeletionsPerformed())
+	assert.EqualValues(t, workers*perWork/4, filter.filter.DeletionsCount())
+	assert.Equal(t, countOccupied(filter.filter.Buckets), filter.filter.OccupiedSlots())
+	for w := 0; w < workers; w++ {
+		for i := 0; i < perWork; i++ {
+			if i%4 != 0 {
+				assert.True(t, filter.Lookup([]byte("StripedFilter_"+strconv.Itoa(w)+"_"+strconv.Itoa(i))))
+			}
+		}
+	}
+
+	filter.Reset()
+	assert.EqualValues(t, 0, filter.CountEntries())
+	assert.False(t, filter.DeletionsPerformed())
+	assert.Zero(t, filter.LoadFactor())
+}
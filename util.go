@@ -1,9 +1,17 @@
 package cuckoo
 
 import (
+	"math"
+	"math/bits"
+
 	metro "github.com/dgryski/go-metro"
 )
 
+// maxBucketPow is the largest supported bucketPow. Primary bucket indices
+// come from the upper 32 bits of the hash, and on 32-bit platforms the
+// encoded filter has to fit in an int.
+const maxBucketPow = 32 - 4*(1-bits.UintSize/64)
+
 var (
 	altHash = [256]uint{}
 	masks   = [65]uint{}
@@ -18,6 +26,18 @@ func init() {
 	}
 }
 
+// AltIndex returns the alternate bucket of fingerprint fp stored in bucket
+// index of a filter with 2^bucketPow buckets, as used by Insert. It is its
+// own inverse: the alternate of the alternate is index again. No filter has
+// more than 2^maxBucketPow buckets, so for a larger bucketPow index is
+// returned unchanged.
+func AltIndex(fp byte, index uint, bucketPow uint) uint {
+	if bucketPow > maxBucketPow {
+		return index
+	}
+	return getAltIndex(fingerprint(fp), index, bucketPow)
+}
+
 func getAltIndex(fp fingerprint, i uint, bucketPow uint) uint {
 	mask := masks[bucketPow]
 	hash := altHash[fp] & mask
@@ -32,14 +52,25 @@ func getFingerprint(hash uint64) byte {
 
 // getIndicesAndFingerprint returns the 2 bucket indices and fingerprint to be used
 func getIndexAndFingerprint(data []byte, bucketPow uint) (uint, fingerprint) {
-	hash := metro.Hash64(data, 1337)
+	return getSaltedIndexAndFingerprint(data, bucketPow, 0)
+}
+
+// getSaltedIndexAndFingerprint is getIndexAndFingerprint with salt mixed
+// into the hash seed; a salt of 0 hashes like an unsalted filter
+func getSaltedIndexAndFingerprint(data []byte, bucketPow uint, salt uint64) (uint, fingerprint) {
+	hash := metro.Hash64(data, 1337^salt)
 	fp := getFingerprint(hash)
 	// Use most significant bits for deriving index.
 	i1 := uint(hash>>32) & masks[bucketPow]
 	return i1, fingerprint(fp)
 }
 
+// getNextPow2 returns the smallest power of two >= n, 1 for n == 0 and 0
+// when the result does not fit in 64 bits.
 func getNextPow2(n uint64) uint {
+	if n == 0 {
+		return 1
+	}
 	n--
 	n |= n >> 1
 	n |= n >> 2
@@ -50,3 +81,90 @@ func getNextPow2(n uint64) uint {
 	n++
 	return uint(n)
 }
+
+// getBucketPow returns the bucketPow of a filter for a given capacity,
+// clamped to [1, maxBucketPow]
+func getBucketPow(capacity uint) uint {
+	n := getNextPow2(uint64(capacity))
+	if n == 0 {
+		// the next power of two overflowed
+		return maxBucketPow
+	}
+	if n/bucketSize < minBuckets {
+		return uint(bits.TrailingZeros(minBuckets))
+	}
+	pow := uint(bits.TrailingZeros(n / bucketSize))
+	if pow > maxBucketPow {
+		return maxBucketPow
+	}
+	return pow
+}
+
+// maxLoadFactors holds the load factors a cuckoo filter with 2 hash
+// functions reaches before inserts start to fail, by bucket size, from
+// Fan et al., "Cuckoo Filter: Practically Better Than Bloom"
+var maxLoadFactors = []struct {
+	bucketSize int
+	load       float64
+}{
+	{2, 0.84},
+	{4, 0.95},
+	{8, 0.98},
+}
+
+// RecommendBucketSize returns the bucket size needing the fewest bits per
+// item to reach targetFPR among those that can be filled to targetLoad,
+// preferring the smaller one on ties. It returns 0 when no bucket size
+// reaches targetLoad or targetFPR is not between 0 and 1. Filter always
+// uses buckets of 4; this is guidance for sizing filters in general.
+func RecommendBucketSize(targetLoad, targetFPR float64) int {
+	if targetFPR <= 0 || targetFPR >= 1 {
+		return 0
+	}
+	best, bestBits := 0, math.Inf(1)
+	for _, m := range maxLoadFactors {
+		if m.load < targetLoad {
+			continue
+		}
+		// A lookup compares against 2*bucketSize fingerprints, so each
+		// needs log2(2b/fpr) bits.
+		bits := math.Log2(2*float64(m.bucketSize)/targetFPR) / m.load
+		if bits < bestBits {
+			best, bestBits = m.bucketSize, bits
+		}
+	}
+	return best
+}
+
+// SizeForReliability returns the smallest NewFilter capacity at which
+// inserting items distinct keys fails with probability at most
+// maxFailureProb. It models the load at which the first insert fails as
+// normally distributed around the maximum load factor for buckets of 4,
+// with a standard deviation shrinking with the square root of the number
+// of slots, which matches measurements of this package with some margin.
+// It returns 0 if maxFailureProb is not positive or no filter is large
+// enough.
+func SizeForReliability(items uint, maxFailureProb float64) uint {
+	if maxFailureProb <= 0 {
+		return 0
+	}
+	for pow := getBucketPow(items); pow <= maxBucketPow; pow++ {
+		slots := uint(bucketSize) << pow
+		if slots < items {
+			continue
+		}
+		if insertFailureProb(items, slots) <= maxFailureProb {
+			return slots
+		}
+	}
+	return 0
+}
+
+// insertFailureProb returns the modelled probability that inserting items
+// distinct keys into a filter with slots slots fails
+func insertFailureProb(items, slots uint) float64 {
+	const mean = 0.95
+	sd := math.Max(0.5/math.Sqrt(float64(slots)), 0.005)
+	z := (float64(items)/float64(slots) - mean) / sd
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
@@ -3,7 +3,12 @@ package cuckoo
 import (
 	"crypto/rand"
 	"io"
+	"math"
 	"math/bits"
+	mrand "math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,12 +25,269 @@ func TestIndexAndFP(t *testing.T) {
 	assert.EqualValues(t, i22, i2)
 }
 
+func TestAltIndex(t *testing.T) {
+	filter := NewFilterPow(10)
+	for i := 0; i < 1000; i++ {
+		data := []byte("AltIndex_" + strconv.Itoa(i))
+		i1, fp := filter.getIndexAndFingerprint(data)
+		_, i2 := filter.CandidateIndices(data)
+		alt := AltIndex(byte(fp), i1, filter.BucketPow)
+		assert.Equal(t, i2, alt)
+		assert.Equal(t, getAltIndex(fp, i1, filter.BucketPow), alt)
+		assert.Equal(t, i1, AltIndex(byte(fp), alt, filter.BucketPow))
+	}
+	for _, pow := range []uint{maxBucketPow + 1, 64, 65, 1000} {
+		assert.EqualValues(t, 7, AltIndex(1, 7, pow))
+	}
+}
+
+func TestDumpSlots(t *testing.T) {
+	filter := NewFilter(10000)
+
+	var hash [32]byte
+	for i := 0; i < 5000; i++ {
+		io.ReadFull(rand.Reader, hash[:])
+		filter.Insert(hash[:])
+	}
+
+	slots := filter.DumpSlots()
+	assert.EqualValues(t, filter.CountEntries(), len(slots))
+	for _, slot := range slots {
+		fp := fingerprint(slot.Fingerprint)
+		assert.EqualValues(t, slot.BucketB, getAltIndex(fp, slot.BucketA, filter.BucketPow))
+		assert.EqualValues(t, slot.BucketA, getAltIndex(fp, slot.BucketB, filter.BucketPow))
+		assert.EqualValues(t, fp, filter.Buckets[slot.BucketA][slot.Slot])
+	}
+}
+
+func TestDrain(t *testing.T) {
+	filter := NewFilter(10000)
+	for i := 0; i < 5000; i++ {
+		filter.Insert([]byte("Drain_" + strconv.Itoa(i)))
+	}
+
+	var drained []SlotInfo
+	for slot := range filter.Drain(nil) {
+		drained = append(drained, slot)
+	}
+	assert.EqualValues(t, filter.CountEntries(), len(drained))
+	assert.Equal(t, filter.DumpSlots(), drained)
+
+	// closing done after a few slots stops the sender and closes the channel
+	done := make(chan struct{})
+	slots := filter.Drain(done)
+	for i := 0; i < 10; i++ {
+		<-slots
+	}
+	close(done)
+	var rest int
+	for range slots {
+		rest++
+	}
+	assert.Less(t, rest, len(drained)-10)
+}
+
+func TestOccupiedPositions(t *testing.T) {
+	filter := NewFilter(10000)
+	for i := 0; i < 5000; i++ {
+		filter.Insert([]byte("OccupiedPositions_" + strconv.Itoa(i)))
+	}
+
+	positions := filter.OccupiedPositions()
+	assert.EqualValues(t, filter.CountEntries(), len(positions))
+	for k, pos := range positions {
+		assert.Less(t, uint(pos), filter.Capacity())
+		assert.NotEqual(t, nullFp, filter.Buckets[pos/bucketSize][pos%bucketSize])
+		if k > 0 {
+			assert.Less(t, positions[k-1], pos)
+		}
+	}
+}
+
 func TestCap(t *testing.T) {
 	const capacity = 10000
 	res := getNextPow2(uint64(capacity)) / bucketSize
 	assert.EqualValues(t, res, 4096)
 }
 
+func TestNewFilterPow(t *testing.T) {
+	filter := NewFilterPow(10)
+	assert.EqualValues(t, 1024, len(filter.Buckets))
+	assert.EqualValues(t, 10, filter.BucketPow)
+
+	var hash [32]byte
+	for i := 0; i < 1000; i++ {
+		io.ReadFull(rand.Reader, hash[:])
+		i1, fp := filter.getIndexAndFingerprint(hash[:])
+		i2 := getAltIndex(fp, i1, filter.BucketPow)
+		assert.Less(t, i1, uint(1024))
+		assert.Less(t, i2, uint(1024))
+	}
+}
+
+func TestNextPow2(t *testing.T) {
+	for n, want := range map[uint64]uint64{0: 1, 1: 1, 2: 2, 3: 4, 4: 4, 5: 8, 1 << 62: 1 << 62, 1<<62 + 1: 1 << 63, 1<<63 + 1: 0} {
+		assert.EqualValues(t, uint(want), getNextPow2(n), "n = %d", n)
+	}
+}
+
+func TestBucketPow(t *testing.T) {
+	for _, tt := range []struct {
+		capacity uint
+		want     uint
+	}{
+		{0, 1},
+		{1, 1},
+		{8, 1},
+		{9, 2},
+		{10000, 12},
+		{math.MaxUint32, 30},
+		{^uint(0), maxBucketPow},
+	} {
+		want := tt.want
+		if want > maxBucketPow {
+			want = maxBucketPow
+		}
+		assert.EqualValues(t, want, getBucketPow(tt.capacity), "capacity = %d", tt.capacity)
+	}
+	assert.Panics(t, func() { NewFilterPow(maxBucketPow + 1) })
+}
+
+func TestLargeBucketPow(t *testing.T) {
+	// masks and indices must agree with 64-bit arithmetic truncated to
+	// the platform's uint for every supported bucketPow
+	var hash [32]byte
+	for pow := uint(0); pow <= maxBucketPow; pow++ {
+		assert.EqualValues(t, uint((uint64(1)<<pow)-1), masks[pow])
+		for i := 0; i < 100; i++ {
+			io.ReadFull(rand.Reader, hash[:])
+			i1, fp := getIndexAndFingerprint(hash[:], pow)
+			i2 := getAltIndex(fp, i1, pow)
+			assert.Less(t, uint64(i1), uint64(1)<<pow)
+			assert.Less(t, uint64(i2), uint64(1)<<pow)
+			assert.EqualValues(t, i1, getAltIndex(fp, i2, pow))
+		}
+	}
+}
+
+func TestSmallCapacity(t *testing.T) {
+	for capacity := uint(0); capacity <= bucketSize; capacity++ {
+		filter := NewFilter(capacity)
+		assert.EqualValues(t, minBuckets, len(filter.Buckets))
+		assert.EqualValues(t, 1, filter.BucketPow)
+
+		for i := uint(0); i < capacity; i++ {
+			assert.True(t, filter.Insert([]byte{byte(i)}))
+		}
+		for i := uint(0); i < capacity; i++ {
+			assert.True(t, filter.Lookup([]byte{byte(i)}))
+		}
+		assert.EqualValues(t, capacity, filter.CountEntries())
+		for i := uint(0); i < capacity; i++ {
+			assert.True(t, filter.Delete([]byte{byte(i)}))
+		}
+		assert.EqualValues(t, 0, filter.CountEntries())
+	}
+}
+
+func TestSingleBucket(t *testing.T) {
+	filter := NewFilterPow(0)
+	assert.EqualValues(t, 1, len(filter.Buckets))
+
+	for i := 0; i < bucketSize; i++ {
+		assert.True(t, filter.Insert([]byte{byte(i)}))
+	}
+	ok, fp, index := filter.InsertSpill([]byte{bucketSize})
+	assert.False(t, ok)
+	assert.NotZero(t, fp)
+	assert.EqualValues(t, 0, index)
+	assert.EqualValues(t, bucketSize, filter.CountEntries())
+	for i := 0; i < bucketSize; i++ {
+		assert.True(t, filter.Lookup([]byte{byte(i)}))
+	}
+
+	assert.True(t, filter.Delete([]byte{0}))
+	assert.EqualValues(t, bucketSize-1, filter.CountEntries())
+	assert.True(t, filter.Insert([]byte{bucketSize}))
+	assert.True(t, filter.Lookup([]byte{bucketSize}))
+
+	filter.Reset()
+	assert.EqualValues(t, 0, filter.CountEntries())
+	for i := 0; i <= bucketSize; i++ {
+		assert.False(t, filter.Delete([]byte{byte(i)}))
+	}
+}
+
+func TestIndexDistribution(t *testing.T) {
+	const samples = 160000
+	histogram := NewFilter(10000).IndexDistribution(samples)
+	assert.Len(t, histogram, 16)
+	for _, n := range histogram {
+		assert.InDelta(t, samples/16, n, samples/16*0.05)
+	}
+
+	assert.Len(t, NewFilter(8).IndexDistribution(samples), 2)
+
+	seeded := func() []int {
+		return NewFilterWithSource(10000, mrand.NewSource(1)).IndexDistribution(1000)
+	}
+	assert.Equal(t, seeded(), seeded())
+}
+
+// chiSquared returns Pearson's statistic of histogram against a uniform
+// distribution of n samples
+func chiSquared(histogram []int, n int) float64 {
+	expected := float64(n) / float64(len(histogram))
+	var chi2 float64
+	for _, observed := range histogram {
+		d := float64(observed) - expected
+		chi2 += d * d / expected
+	}
+	return chi2
+}
+
+func TestHashUniformity(t *testing.T) {
+	// Sequential keys differ in few bits, the hardest case for a weak hash.
+	const pow, n = 10, 1 << 20
+	for _, salt := range []uint64{0, 42} {
+		primary := make([]int, 1<<pow)
+		alternate := make([]int, 1<<pow)
+		fps := make([]int, 255)
+		for i := 0; i < n; i++ {
+			i1, fp := getSaltedIndexAndFingerprint([]byte("key_"+strconv.Itoa(i)), pow, salt)
+			primary[i1]++
+			alternate[getAltIndex(fp, i1, pow)]++
+			fps[fp-1]++
+		}
+		for name, histogram := range map[string][]int{"primary": primary, "alternate": alternate, "fingerprint": fps} {
+			// chi-squared has mean df and variance 2*df under uniformity
+			df := float64(len(histogram) - 1)
+			chi2 := chiSquared(histogram, n)
+			t.Logf("salt %d %s: chi-squared %.1f, df %.0f", salt, name, chi2, df)
+			assert.Less(t, chi2, df+5*math.Sqrt(2*df), "salt %d %s", salt, name)
+		}
+	}
+}
+
+func TestFillHistogram(t *testing.T) {
+	filter := NewFilter(10000)
+	assert.Equal(t, []int{len(filter.Buckets), 0, 0, 0, 0}, filter.FillHistogram())
+	for i := 0; i < 8000; i++ {
+		filter.Insert([]byte("FillHistogram_" + strconv.Itoa(i)))
+	}
+
+	histogram := filter.FillHistogram()
+	assert.Len(t, histogram, bucketSize+1)
+	var buckets, slots int
+	for n, count := range histogram {
+		buckets += count
+		slots += n * count
+	}
+	assert.Equal(t, len(filter.Buckets), buckets)
+	assert.EqualValues(t, filter.CountEntries(), slots)
+	assert.Greater(t, histogram[bucketSize], histogram[0])
+}
+
 func TestInsert(t *testing.T) {
 	const cap = 10000
 	filter := NewFilter(cap)
@@ -37,7 +299,28 @@ func TestInsert(t *testing.T) {
 		filter.Insert(hash[:])
 	}
 
-	assert.EqualValues(t, filter.Count(), 8)
+	assert.EqualValues(t, filter.CountEntries(), 8)
+}
+
+func TestLoadFactor(t *testing.T) {
+	filter := NewFilter(1024)
+	assert.EqualValues(t, 0, filter.LoadFactor())
+	for i := 0; i < 512; i++ {
+		filter.Insert([]byte{byte(i), byte(i >> 8)})
+	}
+	assert.EqualValues(t, 0.5, filter.LoadFactor())
+}
+
+func TestBitsPerItem(t *testing.T) {
+	filter := NewFilter(10000)
+	assert.EqualValues(t, 0, filter.BitsPerItem())
+
+	var hash [32]byte
+	for filter.LoadFactor() < 0.9 {
+		io.ReadFull(rand.Reader, hash[:])
+		filter.Insert(hash[:])
+	}
+	assert.InDelta(t, 8/0.9, filter.BitsPerItem(), 0.01)
 }
 
 func TestFilter_Lookup(t *testing.T) {
@@ -102,3 +385,73 @@ func TestBucket_Reset(t *testing.T) {
 		assert.EqualValues(t, 0, val)
 	}
 }
+
+func TestRecommendBucketSize(t *testing.T) {
+	for _, tc := range []struct {
+		load, fpr float64
+		want      int
+	}{
+		// Fan et al. recommend b=2 for false positive rates above ~0.02
+		// and b=4 below, when both can reach the load.
+		{0.8, 0.1, 2},
+		{0.8, 0.03, 2},
+		{0.8, 0.01, 4},
+		{0.8, 0.0001, 4},
+		// Only larger buckets reach high loads.
+		{0.9, 0.1, 4},
+		{0.97, 0.01, 8},
+		{0.99, 0.01, 0},
+		{0.5, 0, 0},
+		{0.5, 1, 0},
+	} {
+		assert.Equal(t, tc.want, RecommendBucketSize(tc.load, tc.fpr), "load %v fpr %v", tc.load, tc.fpr)
+	}
+}
+
+func TestSizeForReliability(t *testing.T) {
+	assert.EqualValues(t, 4096, SizeForReliability(3700, 0.01))
+	// at 95% load the model gives up on 4096 slots
+	assert.EqualValues(t, 8192, SizeForReliability(3900, 0.01))
+	assert.EqualValues(t, 4096, SizeForReliability(4096, 1))
+	assert.LessOrEqual(t, SizeForReliability(1e6, 0.1), SizeForReliability(1e6, 1e-9))
+	assert.EqualValues(t, 0, SizeForReliability(1000, 0))
+
+	const items, maxFailureProb, seeds = 3700, 0.01, 200
+	capacity := SizeForReliability(items, maxFailureProb)
+	failures := 0
+	for seed := 0; seed < seeds; seed++ {
+		filter := NewFilterWithSource(capacity, mrand.NewSource(int64(seed)))
+		for i := 0; i < items; i++ {
+			if !filter.Insert([]byte(strconv.Itoa(seed) + "_" + strconv.Itoa(i))) {
+				failures++
+				break
+			}
+		}
+	}
+	assert.LessOrEqual(t, float64(failures)/seeds, maxFailureProb)
+}
+
+func TestBucketsPointerFree(t *testing.T) {
+	// The garbage collector does not scan memory without pointers, so a
+	// filter's bucket array costs no mark time however large it is.
+	typ := reflect.TypeOf(NewFilterPow(1).Buckets)
+	assert.Equal(t, reflect.Slice, typ.Kind())
+	assert.Equal(t, reflect.Array, typ.Elem().Kind())
+	assert.Equal(t, reflect.Uint8, typ.Elem().Elem().Kind())
+}
+
+func benchmarkGC(b *testing.B, bucketPow uint) {
+	filter := NewFilterPow(bucketPow)
+	for i := range filter.Buckets {
+		filter.Buckets[i][0] = 1
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+	}
+	runtime.KeepAlive(filter)
+}
+
+func BenchmarkGC_SmallFilter(b *testing.B) { benchmarkGC(b, 1) }
+
+func BenchmarkGC_LargeFilter(b *testing.B) { benchmarkGC(b, 24) }